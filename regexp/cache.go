@@ -0,0 +1,123 @@
+package regexp
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a bounded cache of compiled regular expressions. Once it
+// holds size expressions, the least recently used one is evicted.
+// A Cache is safe for concurrent use by multiple goroutines.
+//
+// The Regexps returned by a Cache are shared by all its callers, so they
+// must not be modified with Longest or Funcs.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+	stats   CacheStats
+}
+
+// cacheKey identifies an expression and the options it was compiled with.
+type cacheKey struct {
+	expr        string
+	freeSpacing bool
+}
+
+type cacheEntry struct {
+	key cacheKey
+	re  Regexp
+	err error
+}
+
+// CacheStats holds the counters of a Cache.
+type CacheStats struct {
+	Hits      uint64 // lookups that found the expression
+	Misses    uint64 // lookups that compiled the expression
+	Evictions uint64 // expressions removed to make room
+	Len       int    // expressions held
+	Size      int    // maximum number of expressions held
+}
+
+// defaultCacheSize is the size of the cache used by Match and MatchString.
+const defaultCacheSize = 512
+
+var helperCache = NewCache(defaultCacheSize)
+
+// NewCache returns a Cache holding at most size compiled expressions.
+// A Cache with a size of zero or less compiles every expression.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Compile is like the package Compile function, but returns the cached
+// result for expr if there is one. Errors are cached as well.
+func (c *Cache) Compile(expr string) (Regexp, error) {
+	return c.compile(cacheKey{expr: expr}, Compile)
+}
+
+// CompileFreeSpacing is like the package CompileFreeSpacing function, but
+// returns the cached result for expr if there is one.
+func (c *Cache) CompileFreeSpacing(expr string) (Regexp, error) {
+	return c.compile(cacheKey{expr: expr, freeSpacing: true}, CompileFreeSpacing)
+}
+
+func (c *Cache) compile(k cacheKey, compile func(string) (Regexp, error)) (Regexp, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[k]; ok {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		ent := e.Value.(*cacheEntry)
+		c.mu.Unlock()
+		return ent.re, ent.err
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	// Expressions are compiled without holding the lock. If several
+	// goroutines compile the same one, the first result is kept.
+	re, err := compile(k.expr)
+	if err != nil {
+		re = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		ent := e.Value.(*cacheEntry)
+		return ent.re, ent.err
+	}
+	if c.size <= 0 {
+		return re, err
+	}
+	for c.lru.Len() >= c.size {
+		last := c.lru.Back()
+		delete(c.entries, last.Value.(*cacheEntry).key)
+		c.lru.Remove(last)
+		c.stats.Evictions++
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{key: k, re: re, err: err})
+	return re, err
+}
+
+// Stats returns the counters of c.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Len = c.lru.Len()
+	s.Size = c.size
+	return s
+}
+
+// Purge removes all expressions from c. The counters are kept.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,114 @@
+package regexp
+
+import (
+	"bytes"
+	gosyntax "regexp/syntax"
+	"runtime"
+	"sync"
+)
+
+// minChunk is the smallest part of the text searched by a goroutine of
+// FindAllSubmatchIndexParallel.
+const minChunk = 1 << 16
+
+// The built-in engine cannot resume a search in the middle of a text, so
+// chunks are only searched in parallel when no match can cross a line:
+// each chunk is then searched on its own, starting after a newline.
+
+func (r *reg) FindAllSubmatchIndexParallel(b []byte, n int) [][]int {
+	starts := lineStarts(b, runtime.GOMAXPROCS(0))
+	if len(starts) < 2 || n == 0 || !lineLocal(r.String()) {
+		return r.FindAllSubmatchIndex(b, n)
+	}
+	parts := make([][][]int, len(starts))
+	var wg sync.WaitGroup
+	for i, lo := range starts {
+		hi := len(b)
+		if i+1 < len(starts) {
+			hi = starts[i+1]
+		}
+		wg.Add(1)
+		go func(i, lo, hi int) {
+			defer wg.Done()
+			for _, loc := range r.FindAllSubmatchIndex(b[lo:hi], n) {
+				// An empty match at the end of a line is found again
+				// at the start of the next one.
+				if hi < len(b) && loc[0] == hi-lo {
+					break
+				}
+				for j := range loc {
+					if loc[j] >= 0 {
+						loc[j] += lo
+					}
+				}
+				parts[i] = append(parts[i], loc)
+			}
+		}(i, lo, hi)
+	}
+	wg.Wait()
+	var ret [][]int
+	for _, locs := range parts {
+		ret = append(ret, locs...)
+		if n >= 0 && len(ret) >= n {
+			return ret[:n]
+		}
+	}
+	return ret
+}
+
+// lineStarts splits b into at most k chunks of at least minChunk bytes
+// that start after a newline, and returns their starts.
+func lineStarts(b []byte, k int) []int {
+	size := len(b) / k
+	if size < minChunk {
+		size = minChunk
+	}
+	starts := []int{0}
+	for lo := size; lo < len(b); lo += size {
+		i := bytes.IndexByte(b[lo:], '\n')
+		if i < 0 || lo+i+1 == len(b) {
+			break
+		}
+		lo += i + 1
+		starts = append(starts, lo)
+	}
+	return starts
+}
+
+// lineLocal reports whether the matches of expr are the same in a line
+// as in the text containing it: expr cannot match a newline, nor depend
+// on the beginning of the text.
+func lineLocal(expr string) bool {
+	re, err := gosyntax.Parse(expr, gosyntax.Perl)
+	if err != nil {
+		return false
+	}
+	return !crossesLines(re)
+}
+
+// crossesLines reports whether re can match a newline or the beginning
+// of the text.
+func crossesLines(re *gosyntax.Regexp) bool {
+	switch re.Op {
+	case gosyntax.OpAnyChar, gosyntax.OpBeginText:
+		return true
+	case gosyntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == '\n' {
+				return true
+			}
+		}
+	case gosyntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '\n' && '\n' <= re.Rune[i+1] {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if crossesLines(sub) {
+			return true
+		}
+	}
+	return false
+}
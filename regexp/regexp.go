@@ -7,7 +7,10 @@ package regexp
 // If you don't use extended syntax, the golang built-in regex engine will be used transparently.
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"iter"
 	"regexp"
 	"strings"
 
@@ -48,6 +51,38 @@ type Regexp interface {
 	// A return value of nil indicates no match.
 	FindSubmatchIndex(b []byte) []int
 
+	// MatchReader reports whether the text returned by the RuneReader
+	// contains any match of the regular expression.
+	// The text is read as needed, and only the part that matching can
+	// still look at is kept in memory.
+	MatchReader(r io.RuneReader) bool
+
+	// FindReaderIndex returns a two-element slice of integers defining the
+	// location of the leftmost match of the regular expression in text read from
+	// the RuneReader.  The match text was found in the input stream at
+	// byte offset loc[0] through loc[1]-1.
+	// A return value of nil indicates no match.
+	FindReaderIndex(r io.RuneReader) (loc []int)
+
+	// FindReaderSubmatchIndex returns a slice holding the index pairs
+	// identifying the leftmost match of the regular expression of text read by
+	// the RuneReader, and the matches, if any, of its subexpressions, as defined
+	// by the 'Submatch' and 'Index' descriptions in the package comment.
+	// A return value of nil indicates no match.
+	FindReaderSubmatchIndex(r io.RuneReader) []int
+
+	// MatchContext is like Match but stops matching and returns ctx.Err()
+	// once ctx is done.
+	MatchContext(ctx context.Context, b []byte) (bool, error)
+
+	// MatchStringContext is like MatchString but stops matching and returns
+	// ctx.Err() once ctx is done.
+	MatchStringContext(ctx context.Context, s string) (bool, error)
+
+	// FindSubmatchIndexContext is like FindSubmatchIndex but stops matching
+	// and returns ctx.Err() once ctx is done.
+	FindSubmatchIndexContext(ctx context.Context, b []byte) ([]int, error)
+
 	// FindString returns a string holding the text of the leftmost match in s of the regular
 	// expression.  If there is no match, the return value is an empty string,
 	// but it will also be empty if the regular expression successfully matches
@@ -93,6 +128,15 @@ type Regexp interface {
 	// A return value of nil indicates no match.
 	FindAllSubmatchIndex(b []byte, n int) [][]int
 
+	// FindAllSubmatchIndexContext is like FindAllSubmatchIndex but stops
+	// matching and returns ctx.Err() once ctx is done.
+	FindAllSubmatchIndexContext(ctx context.Context, b []byte, n int) ([][]int, error)
+
+	// FindAllSubmatchIndexParallel is like FindAllSubmatchIndex but searches
+	// parts of a large b on several goroutines, up to GOMAXPROCS. The
+	// result is the same as the one of FindAllSubmatchIndex.
+	FindAllSubmatchIndexParallel(b []byte, n int) [][]int
+
 	// FindAllSubmatch is the 'All' version of FindSubmatch; it returns a slice
 	// of all successive matches of the expression, as defined by the 'All'
 	// description in the package comment.
@@ -124,6 +168,73 @@ type Regexp interface {
 	// A return value of nil indicates no match.
 	FindAllStringSubmatchIndex(s string, n int) [][]int
 
+	// FindMatch returns the leftmost match in b with the matches of its
+	// subexpressions, or nil if there is none.
+	FindMatch(b []byte) *syntax.Match
+
+	// FindStringMatch is like FindMatch but the input is a string.
+	FindStringMatch(s string) *syntax.Match
+
+	// FindAllMatches is the 'All' version of FindMatch; it returns a slice
+	// of all successive matches of the expression, as defined by the 'All'
+	// description in the package comment.
+	// A return value of nil indicates no match.
+	FindAllMatches(b []byte, n int) []*syntax.Match
+
+	// FindAllStringMatches is like FindAllMatches but the input is a string.
+	FindAllStringMatches(s string, n int) []*syntax.Match
+
+	// AppendIndex appends the location of the leftmost match in b, as
+	// returned by FindIndex, to dst and returns the result.
+	// Nothing is appended if there is no match.
+	AppendIndex(dst []int, b []byte) []int
+
+	// AppendSubmatchIndex appends the index pairs of the leftmost match in b
+	// and of its subexpressions, as returned by FindSubmatchIndex, to dst
+	// and returns the result.
+	// Nothing is appended if there is no match.
+	AppendSubmatchIndex(dst []int, b []byte) []int
+
+	// AppendAllIndex is the 'All' version of AppendIndex; the locations of
+	// the successive matches are appended one after another.
+	AppendAllIndex(dst []int, b []byte, n int) []int
+
+	// AppendAllSubmatchIndex is the 'All' version of AppendSubmatchIndex;
+	// the index pairs of each match are appended one match after another,
+	// 2*(NumSubexp()+1) integers per match.
+	AppendAllSubmatchIndex(dst []int, b []byte, n int) []int
+
+	// AppendStringIndex is like AppendIndex but the input is a string.
+	AppendStringIndex(dst []int, s string) []int
+
+	// AppendStringSubmatchIndex is like AppendSubmatchIndex but the input is
+	// a string.
+	AppendStringSubmatchIndex(dst []int, s string) []int
+
+	// AppendAllStringIndex is like AppendAllIndex but the input is a string.
+	AppendAllStringIndex(dst []int, s string, n int) []int
+
+	// AppendAllStringSubmatchIndex is like AppendAllSubmatchIndex but the
+	// input is a string.
+	AppendAllStringSubmatchIndex(dst []int, s string, n int) []int
+
+	// CountAll returns the number of successive matches in b, as defined by
+	// the 'All' description in the package comment. It counts at most n
+	// matches if n >= 0.
+	CountAll(b []byte, n int) int
+
+	// CountAllString is like CountAll but the input is a string.
+	CountAllString(s string, n int) int
+
+	// All returns an iterator over the successive matches in b, as returned
+	// by FindAllMatches. Each match is only searched for once the previous
+	// one has been consumed, so breaking out of the loop skips the rest of
+	// the work. b must not be modified during the iteration.
+	All(b []byte) iter.Seq[*syntax.Match]
+
+	// AllString is like All but the input is a string.
+	AllString(s string) iter.Seq[*syntax.Match]
+
 	// ReplaceAllFunc returns a copy of src in which all matches of the
 	// Regexp have been replaced by the return value of function repl applied
 	// to the matched byte slice.  The replacement returned by repl is substituted
@@ -136,6 +247,24 @@ type Regexp interface {
 	// directly, without using Expand.
 	ReplaceAllStringFunc(src string, repl func(string) string) string
 
+	// ReplaceAllSubmatchFunc is like ReplaceAllFunc but repl is given the
+	// match with its number and the matches of its subexpressions. The
+	// Match holds the whole of src, as returned by its Source method.
+	ReplaceAllSubmatchFunc(src []byte, repl func(m *syntax.Match) []byte) []byte
+
+	// ReplaceAllStringSubmatchFunc is like ReplaceAllSubmatchFunc but the
+	// input and the replacements are strings.
+	ReplaceAllStringSubmatchFunc(src string, repl func(m *syntax.Match) string) string
+
+	// ReplaceAllSubmatchFuncErr is like ReplaceAllSubmatchFunc but repl can
+	// return an error, which stops the replacement and is returned.
+	ReplaceAllSubmatchFuncErr(src []byte, repl func(m *syntax.Match) ([]byte, error)) ([]byte, error)
+
+	// ReplaceAllStringSubmatchFuncErr is like ReplaceAllStringSubmatchFunc
+	// but repl can return an error, which stops the replacement and is
+	// returned.
+	ReplaceAllStringSubmatchFuncErr(src string, repl func(m *syntax.Match) (string, error)) (string, error)
+
 	// ReplaceAll returns a copy of src, replacing matches of the Regexp
 	// with the replacement text repl.  Inside repl, $ signs are interpreted as
 	// in Expand, so for instance $1 represents the text of the first submatch.
@@ -146,6 +275,48 @@ type Regexp interface {
 	// in Expand, so for instance $1 represents the text of the first submatch.
 	ReplaceAllString(src, repl string) string
 
+	// ReplaceAllContext is like ReplaceAll but stops matching and returns
+	// ctx.Err() once ctx is done.
+	ReplaceAllContext(ctx context.Context, src, repl []byte) ([]byte, error)
+
+	// ReplaceAllStringContext is like ReplaceAllString but stops matching and
+	// returns ctx.Err() once ctx is done.
+	ReplaceAllStringContext(ctx context.Context, src, repl string) (string, error)
+
+	// ReplaceReader copies src to dst, replacing matches of the Regexp with
+	// the replacement text repl.  Inside repl, $ signs are interpreted as in
+	// Expand.  The text is processed as a stream: only the part that
+	// matching can still look at is kept in memory, and text that can no
+	// longer be part of a match is written to dst before more is read.
+	// If the Regexp has inline functions, src is read entirely first.
+	// ReplaceReader returns the first error from reading src or writing dst.
+	ReplaceReader(dst io.Writer, src io.Reader, repl []byte) error
+
+	// ReplaceReaderFunc is like ReplaceReader, but matches are replaced by
+	// the return value of repl applied to the matched text, which is only
+	// valid during the call.
+	ReplaceReaderFunc(dst io.Writer, src io.Reader, repl func([]byte) []byte) error
+
+	// ReplaceAllTemplate returns a copy of src, replacing matches of the
+	// Regexp with the expansion of t.
+	ReplaceAllTemplate(src []byte, t *syntax.Template) []byte
+
+	// ReplaceAllStringTemplate is like ReplaceAllTemplate but the input is
+	// a string.
+	ReplaceAllStringTemplate(src string, t *syntax.Template) string
+
+	// ReplaceAllPreserveCase returns a copy of src, replacing matches of the
+	// Regexp with repl converted to the case of each match, as given by
+	// syntax.PreserveCase: with a pattern matching foo, repl bar replaces
+	// foo, Foo and FOO with bar, Bar and BAR.  The replacement repl is
+	// substituted without using Expand; the ${g:~text} variable of
+	// templates applies the case of a group.
+	ReplaceAllPreserveCase(src, repl []byte) []byte
+
+	// ReplaceAllStringPreserveCase is like ReplaceAllPreserveCase but the
+	// input and the replacement are strings.
+	ReplaceAllStringPreserveCase(src, repl string) string
+
 	// ReplaceAllLiteral returns a copy of src, replacing matches of the Regexp
 	// with the replacement bytes repl.  The replacement repl is substituted directly,
 	// without using Expand.
@@ -173,6 +344,8 @@ type Regexp interface {
 	// equivalent to ${1x}, not ${1}x, and, $10 is equivalent to ${10}, not ${1}0.
 	//
 	// To insert a literal $ in the output, use $$ in the template.
+	//
+	// Templates compiled by CompileTemplate have a richer syntax.
 	Expand(dst []byte, template []byte, src []byte, match []int) []byte
 
 	// ExpandString is like Expand but the template and source are strings.
@@ -227,10 +400,181 @@ type Regexp interface {
 
 type reg struct {
 	*regexp.Regexp
+
+	// ext is the expression compiled by the extended engine, which runs
+	// the methods the built-in engine has no equivalent for.
+	ext Regexp
 }
 
 func (r *reg) Funcs(funcMap syntax.FuncMap) {}
 
+func (r *reg) Longest() {
+	r.Regexp.Longest()
+	r.ext.Longest()
+}
+
+func (r *reg) ReplaceAllPreserveCase(src, repl []byte) []byte {
+	return r.ReplaceAllFunc(src, func(b []byte) []byte {
+		return []byte(syntax.PreserveCase(string(b), string(repl)))
+	})
+}
+
+func (r *reg) ReplaceAllStringPreserveCase(src, repl string) string {
+	return r.ReplaceAllStringFunc(src, func(s string) string {
+		return syntax.PreserveCase(s, repl)
+	})
+}
+
+// The built-in engine has neither Match values, iterators nor stream
+// replacement, so they run on the extended one.
+
+func (r *reg) FindMatch(b []byte) *syntax.Match {
+	return r.ext.FindMatch(b)
+}
+
+func (r *reg) FindStringMatch(s string) *syntax.Match {
+	return r.ext.FindStringMatch(s)
+}
+
+func (r *reg) FindAllMatches(b []byte, n int) []*syntax.Match {
+	return r.ext.FindAllMatches(b, n)
+}
+
+func (r *reg) FindAllStringMatches(s string, n int) []*syntax.Match {
+	return r.ext.FindAllStringMatches(s, n)
+}
+
+func (r *reg) ReplaceAllSubmatchFunc(src []byte, repl func(m *syntax.Match) []byte) []byte {
+	return r.ext.ReplaceAllSubmatchFunc(src, repl)
+}
+
+func (r *reg) ReplaceAllStringSubmatchFunc(src string, repl func(m *syntax.Match) string) string {
+	return r.ext.ReplaceAllStringSubmatchFunc(src, repl)
+}
+
+func (r *reg) ReplaceAllSubmatchFuncErr(src []byte, repl func(m *syntax.Match) ([]byte, error)) ([]byte, error) {
+	return r.ext.ReplaceAllSubmatchFuncErr(src, repl)
+}
+
+func (r *reg) ReplaceAllStringSubmatchFuncErr(src string, repl func(m *syntax.Match) (string, error)) (string, error) {
+	return r.ext.ReplaceAllStringSubmatchFuncErr(src, repl)
+}
+
+func (r *reg) ReplaceAllTemplate(src []byte, t *syntax.Template) []byte {
+	return r.ext.ReplaceAllTemplate(src, t)
+}
+
+func (r *reg) ReplaceAllStringTemplate(src string, t *syntax.Template) string {
+	return r.ext.ReplaceAllStringTemplate(src, t)
+}
+
+func (r *reg) All(b []byte) iter.Seq[*syntax.Match] {
+	return r.ext.All(b)
+}
+
+func (r *reg) AllString(s string) iter.Seq[*syntax.Match] {
+	return r.ext.AllString(s)
+}
+
+func (r *reg) ReplaceReader(dst io.Writer, src io.Reader, repl []byte) error {
+	return r.ext.ReplaceReader(dst, src, repl)
+}
+
+func (r *reg) ReplaceReaderFunc(dst io.Writer, src io.Reader, repl func([]byte) []byte) error {
+	return r.ext.ReplaceReaderFunc(dst, src, repl)
+}
+
+// The built-in engine runs in linear time, so the context variants
+// only check ctx before matching.
+
+func (r *reg) MatchContext(ctx context.Context, b []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return r.Match(b), nil
+}
+
+func (r *reg) MatchStringContext(ctx context.Context, s string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return r.MatchString(s), nil
+}
+
+func (r *reg) FindSubmatchIndexContext(ctx context.Context, b []byte) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.FindSubmatchIndex(b), nil
+}
+
+func (r *reg) FindAllSubmatchIndexContext(ctx context.Context, b []byte, n int) ([][]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.FindAllSubmatchIndex(b, n), nil
+}
+
+func (r *reg) ReplaceAllContext(ctx context.Context, src, repl []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.ReplaceAll(src, repl), nil
+}
+
+func (r *reg) ReplaceAllStringContext(ctx context.Context, src, repl string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ReplaceAllString(src, repl), nil
+}
+
+// The built-in engine has no append variants and allocates the result of
+// every match it finds, so the methods that append to a caller's slice or
+// count matches run on the extended engine. It only allocates where it
+// hands a part of the expression over to the built-in engine, once per
+// match of that part.
+
+func (r *reg) AppendIndex(dst []int, b []byte) []int {
+	return r.ext.AppendIndex(dst, b)
+}
+
+func (r *reg) AppendSubmatchIndex(dst []int, b []byte) []int {
+	return r.ext.AppendSubmatchIndex(dst, b)
+}
+
+func (r *reg) AppendAllIndex(dst []int, b []byte, n int) []int {
+	return r.ext.AppendAllIndex(dst, b, n)
+}
+
+func (r *reg) AppendAllSubmatchIndex(dst []int, b []byte, n int) []int {
+	return r.ext.AppendAllSubmatchIndex(dst, b, n)
+}
+
+func (r *reg) AppendStringIndex(dst []int, s string) []int {
+	return r.ext.AppendStringIndex(dst, s)
+}
+
+func (r *reg) AppendStringSubmatchIndex(dst []int, s string) []int {
+	return r.ext.AppendStringSubmatchIndex(dst, s)
+}
+
+func (r *reg) AppendAllStringIndex(dst []int, s string, n int) []int {
+	return r.ext.AppendAllStringIndex(dst, s, n)
+}
+
+func (r *reg) AppendAllStringSubmatchIndex(dst []int, s string, n int) []int {
+	return r.ext.AppendAllStringSubmatchIndex(dst, s, n)
+}
+
+func (r *reg) CountAll(b []byte, n int) int {
+	return r.ext.CountAll(b, n)
+}
+
+func (r *reg) CountAllString(s string, n int) int {
+	return r.ext.CountAllString(s, n)
+}
+
 // Compile parses a regular expression and returns, if successful,
 // a Regexp object that can be used to match against text.
 func Compile(expr string) (Regexp, error) {
@@ -242,9 +586,13 @@ func Compile(expr string) (Regexp, error) {
 		return r, nil
 	}
 	re, err := regexp.Compile(ignoreComments(expr))
+	if err != nil {
+		return nil, err
+	}
 	return &reg{
 		Regexp: re,
-	}, err
+		ext:    r,
+	}, nil
 }
 
 // CompileFreeSpacing parses a regular expression like Compile,
@@ -258,9 +606,13 @@ func CompileFreeSpacing(expr string) (Regexp, error) {
 		return r, nil
 	}
 	re, err := regexp.Compile(ignoreComments(ignoreCommentsAndSpaces(expr)))
+	if err != nil {
+		return nil, err
+	}
 	return &reg{
 		Regexp: re,
-	}, err
+		ext:    r,
+	}, nil
 }
 
 func compile(expr string) (Regexp, error) {
@@ -303,8 +655,9 @@ func mustCompile(expr string) Regexp {
 // Match checks whether a textual regular expression
 // matches a byte slice.  More complicated queries need
 // to use Compile and the full Regexp interface.
+// The most recently used expressions are kept compiled.
 func Match(pattern string, b []byte) (matched bool, err error) {
-	re, err := Compile(pattern)
+	re, err := helperCache.Compile(pattern)
 	if err != nil {
 		return false, err
 	}
@@ -314,14 +667,27 @@ func Match(pattern string, b []byte) (matched bool, err error) {
 // MatchString checks whether a textual regular expression
 // matches a string.  More complicated queries need
 // to use Compile and the full Regexp interface.
+// The most recently used expressions are kept compiled.
 func MatchString(pattern string, s string) (matched bool, err error) {
-	re, err := Compile(pattern)
+	re, err := helperCache.Compile(pattern)
 	if err != nil {
 		return false, err
 	}
 	return re.MatchString(s), nil
 }
 
+// CompileTemplate parses a replacement template for ReplaceAllTemplate.
+// The syntax is described in the documentation of syntax.Template.
+func CompileTemplate(template string) (*syntax.Template, error) {
+	return syntax.CompileTemplate(template)
+}
+
+// MustCompileTemplate is like CompileTemplate but panics if the template
+// cannot be parsed.
+func MustCompileTemplate(template string) *syntax.Template {
+	return syntax.MustCompileTemplate(template)
+}
+
 // QuoteMeta returns a string that quotes all regular expression metacharacters
 // inside the argument text; the returned string is a regular expression matching
 // the literal text.  For example, QuoteMeta(`[foo]`) returns `\[foo\]`.
@@ -329,7 +695,7 @@ func QuoteMeta(s string) string {
 	return regexp.QuoteMeta(s)
 }
 
-var commentRegexp = regexp.MustCompile(`(^|[^\\]|\\\\)(\(\?#[^)]*\))`)
+var commentRegexp = regexp.MustCompile(`(^|[^\\]|\\\\)((?:\(\?#[^)]*\))+)`)
 
 func ignoreComments(expr string) string {
 	return commentRegexp.ReplaceAllString(expr, "$1")
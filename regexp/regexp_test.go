@@ -2,16 +2,29 @@ package regexp
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
 
 	"reflect"
 	gre "regexp"
+	gosyntax "regexp/syntax"
+
+	"github.com/Upliner/goback/regexp/syntax"
 )
 
 func AssertBuiltIn(t *testing.T, exp, str string) {
@@ -40,12 +53,32 @@ func AssertBuiltIn(t *testing.T, exp, str string) {
 		t.Errorf("%#q.FindStringIndex(%#q) = %v, want %v", exp, str, rf, gf)
 	}
 
+	if rb, gb := r.MatchString(str), g.MatchString(str); rb != gb {
+		t.Errorf("%#q.MatchString(%#q) = %v, want %v", exp, str, rb, gb)
+	}
+
 	rs := r.Split(str, -1)
 	gs := g.Split(str, -1)
 	if !reflect.DeepEqual(rs, gs) {
 		t.Errorf("%#q.Split(%#q) = %v, want %v", exp, str, rs, gs)
 	}
 
+	rr := r.FindReaderSubmatchIndex(strings.NewReader(str))
+	if !reflect.DeepEqual(gm, rr) {
+		t.Errorf("%#q.FindReaderSubmatchIndex(%#q) = %v, want %v", exp, str, rr, gm)
+	}
+
+	var ra [][]int
+	for m := range r.AllString(str) {
+		if m.Index() != len(ra) {
+			t.Errorf("%#q.AllString(%#q) yielded match %d as number %d", exp, str, len(ra), m.Index())
+		}
+		ra = append(ra, matchLoc(m, r.NumSubexp()))
+	}
+	if ga := g.FindAllStringSubmatchIndex(str, -1); !reflect.DeepEqual(ga, ra) {
+		t.Errorf("%#q.AllString(%#q) = %v, want %v", exp, str, ra, ga)
+	}
+
 	r.Longest()
 	g.Longest()
 
@@ -55,6 +88,13 @@ func AssertBuiltIn(t *testing.T, exp, str string) {
 	if !reflect.DeepEqual(gm, rm) {
 		t.Errorf("%#q.FindSubmatchIndex(%#q) [Longest] = %v, want %v", exp, str, rm, gm)
 	}
+
+	rf = r.FindStringIndex(str)
+	gf = g.FindStringIndex(str)
+
+	if !reflect.DeepEqual(gf, rf) {
+		t.Errorf("%#q.FindStringIndex(%#q) [Longest] = %v, want %v", exp, str, rf, gf)
+	}
 }
 
 func AssertError(t *testing.T, exp string) {
@@ -65,10 +105,25 @@ func AssertError(t *testing.T, exp string) {
 }
 
 func AssertEqual(t *testing.T, exp, str string, res []int) {
-	r := mustCompile(exp).FindStringSubmatchIndex(str)
+	re := mustCompile(exp)
+	r := re.FindStringSubmatchIndex(str)
 	if !reflect.DeepEqual(res, r) {
 		t.Errorf("%#q.FindSubmatchIndex(%#q) = %v, want %v", exp, str, r, res)
 	}
+
+	var loc []int
+	if res != nil {
+		loc = res[:2]
+	}
+	if f := re.FindStringIndex(str); !reflect.DeepEqual(loc, f) {
+		t.Errorf("%#q.FindStringIndex(%#q) = %v, want %v", exp, str, f, loc)
+	}
+	if m := re.MatchString(str); m != (res != nil) {
+		t.Errorf("%#q.MatchString(%#q) = %v, want %v", exp, str, m, res != nil)
+	}
+	if r := re.FindReaderSubmatchIndex(strings.NewReader(str)); !reflect.DeepEqual(res, r) {
+		t.Errorf("%#q.FindReaderSubmatchIndex(%#q) = %v, want %v", exp, str, r, res)
+	}
 }
 
 func TestBuiltIn(t *testing.T) {
@@ -131,6 +186,126 @@ func TestInvalid(t *testing.T) {
 	}
 }
 
+func TestError(t *testing.T) {
+	for _, c := range []struct {
+		exp          string
+		code         gosyntax.ErrorCode
+		expr         string
+		offset, rune int
+	}{
+		{`a(b`, gosyntax.ErrMissingParen, `(b`, 1, 1},
+		{`ab)`, gosyntax.ErrUnexpectedParen, `)`, 2, 2},
+		{`x\qy`, gosyntax.ErrInvalidEscape, `\q`, 1, 1},
+		{`é[z-a]`, gosyntax.ErrInvalidCharRange, `z-a`, 3, 2},
+		{`a**`, gosyntax.ErrInvalidRepeatOp, `**`, 1, 1},
+		{"a\xffb", gosyntax.ErrInvalidUTF8, "\xffb", 1, 1},
+		{`正規(?<=表+)x`, syntax.ErrUnboundedLookbehind, `(?<=表+)`, 6, 2},
+		{`(?{})`, syntax.ErrInvalidFunctionCall, `(?{})`, 0, 0},
+		{`a\k`, syntax.ErrInvalidBackref, `\k`, 1, 1},
+		{`(a)\k{b}(?P<b>c)\k{d}`, syntax.ErrUndefinedBackref, `\k{d}`, 16, 16},
+		{`\1`, gosyntax.ErrInvalidEscape, `\1`, 0, 0},
+		{`x|+`, gosyntax.ErrMissingRepeatArgument, `+`, 2, 2},
+		{`a+|正*|*`, gosyntax.ErrMissingRepeatArgument, `*`, 8, 6},
+		{`a|*(?{f})`, gosyntax.ErrMissingRepeatArgument, `*`, 2, 2},
+		{`é(?i)|{2,}(?{f})`, gosyntax.ErrMissingRepeatArgument, `{2,}`, 7, 6},
+		{`(?:|*^)(?{f})`, gosyntax.ErrMissingRepeatArgument, `*`, 4, 4},
+		{`(?#\1)a\1`, gosyntax.ErrInvalidEscape, `\1`, 7, 7},
+	} {
+		_, err := Compile(c.exp)
+		var e *syntax.Error
+		if !errors.As(err, &e) {
+			t.Errorf("Compile(%#q) error = %v, want a *syntax.Error", c.exp, err)
+			continue
+		}
+		if e.Code != c.code || e.Expr != c.expr || e.Offset != c.offset || e.RuneOffset != c.rune || e.Pattern != c.exp {
+			t.Errorf("Compile(%#q) error = %+v, want %s: %#q at %d, rune %d", c.exp, e, c.code, c.expr, c.offset, c.rune)
+		}
+		var std *gosyntax.Error
+		extended := c.code == syntax.ErrUnboundedLookbehind || c.code == syntax.ErrInvalidFunctionCall || c.code == syntax.ErrInvalidBackref || c.code == syntax.ErrUndefinedBackref
+		if ok := errors.As(err, &std); ok == extended || ok && (std.Code != c.code || std.Expr != c.expr) {
+			t.Errorf("Compile(%#q) error unwraps to %v", c.exp, std)
+		}
+	}
+
+	for exp, want := range map[string]string{
+		`a(b|c`:       "a(b|c\n ^~~~",
+		"a(?<=b*)\nc": "a(?<=b*)\n ^~~~~~~",
+		"x\n\t[b-a]":  "\t[b-a]\n\t ^~~",
+		`ab\`:         "ab\\\n  ^",
+		`a|*(?{f})`:   "a|*(?{f})\n  ^",
+	} {
+		_, err := Compile(exp)
+		var e *syntax.Error
+		if !errors.As(err, &e) {
+			t.Errorf("Compile(%#q) error = %v, want a *syntax.Error", exp, err)
+		} else if got := e.Caret(); got != want {
+			t.Errorf("Compile(%#q) error Caret() =\n%s\nwant\n%s", exp, got, want)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	for _, exp := range []string{`(?#a)正規`, `正(?#a)(?#b)規`, `(?#a)(?#b)(?#c)正規`} {
+		re, err := Compile(exp)
+		if err != nil {
+			t.Errorf("Compile(%#q) error = %v", exp, err)
+		} else if loc := re.FindStringIndex("表正規"); !reflect.DeepEqual(loc, []int{3, 9}) {
+			t.Errorf("%#q.FindStringIndex = %v, want [3 9]", exp, loc)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for exp, want := range map[string][]string{
+		`ok(?:a|b)+`:                 nil,
+		`a)b)c`:                      {"1 error: unexpected ): `)`", "3 error: unexpected ): `)`"},
+		`\qx\E(y`:                    {"0 error: invalid escape sequence: `\\q`", "3 error: invalid escape sequence: `\\E`", "5 error: missing closing ): `(y`"},
+		`a{3,2}b(c\d`:                {"1 error: invalid repeat count: `{3,2}`", "7 error: missing closing ): `(c\\d`"},
+		`(?Q)a(b\y)c[z`:              {"0 error: invalid or unsupported Perl syntax: `(?Q)`", "7 error: invalid escape sequence: `\\y`", "11 error: missing closing ]: `[z`"},
+		`**a\`:                       {"0 error: missing argument to repetition operator: `*`", "1 error: missing argument to repetition operator: `*`", "3 error: trailing backslash at end of expression: `\\`"},
+		`(?P<n>a)\k{m}\k{n}\k2\k1`:   {"8 error: back reference to an undefined group: `\\k{m}`", "18 error: back reference to an undefined group: `\\k2`"},
+		`a||b|`:                      {"2 warning: empty alternative: `|`", "4 warning: empty alternative: `|`"},
+		`(|a)|(?i)|b`:                {"1 warning: empty alternative: `|`", "9 warning: empty alternative: `|`"},
+		`(a+)*(?:a|b*)+(?>a*)*(a?)*`: {"4 warning: nested quantifier: `*`", "13 warning: nested quantifier: `+`"},
+		`(x*)*[b-a]`:                 {"4 warning: nested quantifier: `*`", "6 error: invalid character class range: `b-a`"},
+		"é(\xff":                     {"2 error: invalid UTF-8: `\xff`"},
+		`(?{`:                        {"0 error: missing closing ): `(?{`"},
+		`(?=a**`:                     {"0 error: missing closing ): `(?=a**`", "4 error: invalid nested repetition operator: `**`"},
+		`(?#abc`:                     {"0 error: missing closing ): `(?#abc`"},
+		`(?>a`:                       {"0 error: missing closing ): `(?>a`"},
+		`(?i`:                        {"0 error: missing closing ): `(?i`"},
+		`b(?P<n>a`:                   {"1 error: missing closing ): `(?P<n>a`"},
+		`\1`:                         {"0 error: invalid escape sequence: `\\1`"},
+		`x|+`:                        {"2 error: missing argument to repetition operator: `+`"},
+		`?a`:                         {"0 error: missing argument to repetition operator: `?`"},
+		`(a)|*\k1`:                   {"4 error: missing argument to repetition operator: `*`"},
+	} {
+		var got []string
+		for _, d := range syntax.Check(exp, syntax.CheckOptions{Warnings: true}) {
+			got = append(got, fmt.Sprint(d.RuneOffset, " ", d))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Check(%#q) =\n%q\nwant\n%q", exp, got, want)
+		}
+		var errs []string
+		for _, s := range want {
+			if !strings.Contains(s, "warning") {
+				errs = append(errs, s)
+			}
+		}
+		got = nil
+		for _, d := range syntax.Check(exp, syntax.CheckOptions{}) {
+			got = append(got, fmt.Sprint(d.RuneOffset, " ", d))
+		}
+		if !reflect.DeepEqual(got, errs) {
+			t.Errorf("Check(%#q) without warnings =\n%q\nwant\n%q", exp, got, errs)
+		}
+		if _, err := Compile(exp); (err != nil) != (len(errs) > 0) && !strings.Contains(exp, `\k`) {
+			t.Errorf("Compile(%#q) error = %v, want one iff Check reports errors", exp, err)
+		}
+	}
+}
+
 func TestExtended(t *testing.T) {
 	file, err := os.Open("./_testdata/extended.txt")
 	if err != nil {
@@ -176,6 +351,110 @@ func TestExtended(t *testing.T) {
 	}
 }
 
+func TestContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, r := range []Regexp{mustCompile(`(a+)b`), MustCompile(`(a+)b`)} {
+		if _, err := r.MatchContext(canceled, []byte("aaab")); err != context.Canceled {
+			t.Errorf("%#q.MatchContext(canceled) error = %v, want %v", r, err, context.Canceled)
+		}
+		if _, err := r.FindSubmatchIndexContext(canceled, []byte("aaab")); err != context.Canceled {
+			t.Errorf("%#q.FindSubmatchIndexContext(canceled) error = %v, want %v", r, err, context.Canceled)
+		}
+		if _, err := r.ReplaceAllStringContext(canceled, "aaab", "x"); err != context.Canceled {
+			t.Errorf("%#q.ReplaceAllStringContext(canceled) error = %v, want %v", r, err, context.Canceled)
+		}
+
+		m, err := r.MatchStringContext(context.Background(), "aaab")
+		if err != nil || !m {
+			t.Errorf("%#q.MatchStringContext(%#q) = %v, %v, want true, nil", r, "aaab", m, err)
+		}
+		loc, err := r.FindAllSubmatchIndexContext(context.Background(), []byte("ab aab"), -1)
+		if want := [][]int{{0, 2, 0, 1}, {3, 6, 3, 5}}; err != nil || !reflect.DeepEqual(loc, want) {
+			t.Errorf("%#q.FindAllSubmatchIndexContext = %v, %v, want %v, nil", r, loc, err, want)
+		}
+		res, err := r.ReplaceAllContext(context.Background(), []byte("ab aab"), []byte("<$1>"))
+		if err != nil || string(res) != "<a> <aa>" {
+			t.Errorf("%#q.ReplaceAllContext = %q, %v, want %q, nil", r, res, err, "<a> <aa>")
+		}
+	}
+
+	// The callout never succeeds, so the engine explores every way to
+	// split the input between the nested repetitions.
+	r := mustCompile(`(a*)*(?{never})`)
+	r.Funcs(syntax.FuncMap{
+		"never": func(ctx syntax.Context) interface{} {
+			return -1
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.MatchStringContext(ctx, strings.Repeat("a", 64))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("%#q.MatchStringContext() error = %v, want %v", r, err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%#q.MatchStringContext() did not return after the deadline", r)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	r := mustCompile(`a(?{f})(?{g})b`)
+	if r.MatchString("ab") {
+		t.Errorf("%#q matched with no function registered", r)
+	}
+	r.Funcs(syntax.FuncMap{
+		"f": func(ctx syntax.Context) interface{} { return nil },
+	})
+	r.Funcs(syntax.FuncMap{
+		"f": func(ctx syntax.Context) interface{} { return -1 },
+		"g": func(ctx syntax.Context) interface{} { return 1 },
+	})
+	// f is the first function registered under its name, g skips a rune.
+	if loc := r.FindStringIndex("axb"); !reflect.DeepEqual(loc, []int{0, 3}) {
+		t.Errorf("%#q.FindStringIndex(%#q) = %v, want [0 3]", r, "axb", loc)
+	}
+}
+
+func TestMemoization(t *testing.T) {
+	for _, c := range []struct {
+		exp, str string
+		want     []int
+	}{
+		{`(a*)*b`, strings.Repeat("a", 16), nil},
+		{`(a*)*b`, strings.Repeat("a", 16) + "b", []int{0, 17, 0, 16}},
+		{`(?:a|aa)*c`, strings.Repeat("a", 32), nil},
+		{`^(\w+\s?)*$`, strings.Repeat("word ", 6) + "!", nil},
+		{`(?=(a+)+b)`, strings.Repeat("a", 16), nil},
+		{`(?>a+)(a|aa)*c`, strings.Repeat("a", 24), nil},
+		{`(a+a+)+y`, strings.Repeat("a", 16), nil},
+		// A trailing assertion keeps the loops out of the built-in engine.
+		{`(a*)*(?=b)`, strings.Repeat("a", 16), nil},
+		{`(?:a|aa)*(?=c)`, strings.Repeat("a", 32), nil},
+		// Back references limit memoization to groups without captures.
+		{`^(a|ab)(c|bcd)(d*)\k{3}$`, "abcdd", []int{0, 5, 0, 2, 2, 3, 3, 4}},
+		{`^(a|ab)(c|bcd)(d*)\k{3}$`, "abcdx", nil},
+		{`^(a|ab)(c|bcd)(d*)\k{1}$`, "abcda", []int{0, 5, 0, 1, 1, 4, 4, 4}},
+		{`(?:(a)|b)+\k{1}`, "abba", []int{0, 4, 0, 1}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		loc, err := mustCompile(c.exp).FindSubmatchIndexContext(ctx, []byte(c.str))
+		cancel()
+		if err != nil {
+			t.Errorf("%#q.FindSubmatchIndex(%#q) error = %v", c.exp, c.str, err)
+		} else if !reflect.DeepEqual(loc, c.want) {
+			t.Errorf("%#q.FindSubmatchIndex(%#q) = %v, want %v", c.exp, c.str, loc, c.want)
+		}
+	}
+}
+
 func getBenchmarkData() ([]byte, error) {
 	file, err := os.Open("./_testdata/アーサー王物語.txt.gz")
 	if err != nil {
@@ -191,6 +470,515 @@ func getBenchmarkData() ([]byte, error) {
 	return ioutil.ReadAll(gz)
 }
 
+func TestRepetition(t *testing.T) {
+	for _, c := range []struct {
+		exp, str string
+		want     []int
+	}{
+		{`(?:ab|cd){1000}(?=x)`, strings.Repeat("ab", 1000) + "x", []int{0, 2000}},
+		{`(?:ab|cd){100}(?=x)`, strings.Repeat("ab", 99) + "x", nil},
+		{`(\w+\s){2,500}(?=!)`, strings.Repeat("ab ", 400) + "!", []int{0, 1200, 1197, 1200}},
+		{`(\w+\s){2,500}?(?=ab)`, strings.Repeat("ab ", 400), []int{0, 6, 3, 6}},
+		{`(?:a|ab){300,}c(?=$)`, strings.Repeat("ab", 300) + "c", []int{0, 601}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		loc, err := mustCompile(c.exp).FindSubmatchIndexContext(ctx, []byte(c.str))
+		cancel()
+		if err != nil {
+			t.Errorf("%#q.FindSubmatchIndex(%#q) error = %v", c.exp, c.str, err)
+		} else if !reflect.DeepEqual(loc, c.want) {
+			t.Errorf("%#q.FindSubmatchIndex(%#q) = %v, want %v", c.exp, c.str, loc, c.want)
+		}
+	}
+}
+
+func TestSubmatchAllocs(t *testing.T) {
+	re := mustCompile(`(\w+)\s(\w+)(?=!)`)
+	allocs := func(n int) float64 {
+		b := []byte(strings.Repeat("ab cd ", n) + "x y!")
+		return testing.AllocsPerRun(10, func() {
+			re.FindSubmatchIndex(b)
+		})
+	}
+	// Allocations do not depend on the number of attempts before the match.
+	if short, long := allocs(10), allocs(1000); long > short+5 {
+		t.Errorf("FindSubmatchIndex allocations = %v for 10 words, %v for 1000", short, long)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, c := range []struct {
+		exp, str string
+	}{
+		{`a+`, "baaacaad"},
+		{`(a)|b(?=c)`, "bcab"},
+		{`x*`, "axxb"},
+		{`(?<=a)(b)(c)?`, "abcabab"},
+		{`(\w)\k{1}`, "aabbcd"},
+		{`(?i)ß`, "ßSSss"},
+		{`z`, "abc"},
+	} {
+		for _, re := range []Regexp{mustCompile(c.exp), MustCompile(c.exp)} {
+			all := re.FindAllStringSubmatchIndex(c.str, -1)
+			var flat, bounds []int
+			for _, loc := range all {
+				flat = append(flat, loc...)
+				bounds = append(bounds, loc[:2]...)
+			}
+			dst := []int{-9}
+			if got := re.AppendAllStringSubmatchIndex(dst, c.str, -1); !reflect.DeepEqual(got, append(dst, flat...)) {
+				t.Errorf("%#q.AppendAllStringSubmatchIndex(%#q) = %v, want %v", c.exp, c.str, got, append(dst, flat...))
+			}
+			if got := re.AppendAllIndex(dst, []byte(c.str), -1); !reflect.DeepEqual(got, append(dst, bounds...)) {
+				t.Errorf("%#q.AppendAllIndex(%#q) = %v, want %v", c.exp, c.str, got, append(dst, bounds...))
+			}
+			if got := re.AppendAllIndex(nil, []byte(c.str), 1); len(all) > 0 && !reflect.DeepEqual(got, all[0][:2]) {
+				t.Errorf("%#q.AppendAllIndex(%#q, 1) = %v, want %v", c.exp, c.str, got, all[0][:2])
+			}
+			want := append(dst, re.FindStringSubmatchIndex(c.str)...)
+			if got := re.AppendStringSubmatchIndex(dst, c.str); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.AppendStringSubmatchIndex(%#q) = %v, want %v", c.exp, c.str, got, want)
+			}
+			want = append(dst, re.FindIndex([]byte(c.str))...)
+			if got := re.AppendIndex(dst, []byte(c.str)); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.AppendIndex(%#q) = %v, want %v", c.exp, c.str, got, want)
+			}
+			if n := re.CountAllString(c.str, -1); n != len(all) {
+				t.Errorf("%#q.CountAllString(%#q) = %v, want %v", c.exp, c.str, n, len(all))
+			}
+			if n, want := re.CountAll([]byte(c.str), 1), len(re.FindAllIndex([]byte(c.str), 1)); n != want {
+				t.Errorf("%#q.CountAll(%#q, 1) = %v, want %v", c.exp, c.str, n, want)
+			}
+		}
+	}
+}
+
+func TestUnsetSubmatch(t *testing.T) {
+	re := mustCompile(`(a)|b(?=c)`)
+	if m := re.FindSubmatch([]byte("bc")); len(m) != 2 || m[1] != nil {
+		t.Errorf("FindSubmatch = %q, want an unset group", m)
+	}
+	if m := re.FindStringSubmatch("bc"); !reflect.DeepEqual(m, []string{"b", ""}) {
+		t.Errorf("FindStringSubmatch = %q, want [b ]", m)
+	}
+}
+
+func TestAppendAllocs(t *testing.T) {
+	dst := make([]int, 0, 8192)
+	for _, re := range []Regexp{
+		mustCompile(`\w+(?=\s)`),
+		MustCompile(`\w+`),
+		MustCompile(`(\w+)\s`),
+	} {
+		allocs := func(n int) (float64, float64, float64) {
+			s := strings.Repeat("ab cd ", n)
+			count := testing.AllocsPerRun(10, func() {
+				re.CountAllString(s, -1)
+			})
+			appends := testing.AllocsPerRun(10, func() {
+				re.AppendAllStringIndex(dst[:0], s, -1)
+			})
+			submatches := testing.AllocsPerRun(10, func() {
+				re.AppendAllStringSubmatchIndex(dst[:0], s, -1)
+			})
+			return count, appends, submatches
+		}
+		// Allocations do not depend on the number of matches. Idle machines
+		// can be dropped from the pool at any time, so a few more are allowed.
+		c1, a1, s1 := allocs(10)
+		c2, a2, s2 := allocs(1000)
+		if c2 > c1+5 {
+			t.Errorf("%v: CountAllString allocations = %v for 20 matches, %v for 2000", re, c1, c2)
+		}
+		if a2 > a1+5 {
+			t.Errorf("%v: AppendAllStringIndex allocations = %v for 20 matches, %v for 2000", re, a1, a2)
+		}
+		if s2 > s1+5 {
+			t.Errorf("%v: AppendAllStringSubmatchIndex allocations = %v for 20 matches, %v for 2000", re, s1, s2)
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	re := mustCompile(`(\w+)@(\w+)(?=\.)|(a|b|ab)*c(?<=bc)`)
+	inputs := []string{
+		"x mail@example.com y",
+		strings.Repeat("ab", 500) + "bc",
+		strings.Repeat("ab", 500) + "x",
+		"nothing here",
+	}
+	want := make([][][]int, len(inputs))
+	for i, s := range inputs {
+		want[i] = re.FindAllStringSubmatchIndex(s, -1)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := 0; k < 50; k++ {
+				i := (g + k) % len(inputs)
+				if got := re.FindAllStringSubmatchIndex(inputs[i], -1); !reflect.DeepEqual(got, want[i]) {
+					t.Errorf("FindAllStringSubmatchIndex(%.20q) = %v, want %v", inputs[i], got, want[i])
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestFindAllMemo(t *testing.T) {
+	// Explored states recorded by a search must not be reused by the next one.
+	re := mustCompile(`((|(?:)*(é)())((é))(?=))*[^}]*?(?m:$)`)
+	var got [][]int
+	for _, loc := range re.FindAllStringIndex("a\n", -1) {
+		got = append(got, loc)
+	}
+	if want := [][]int{{0, 1}, {2, 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAllStringIndex = %v, want %v", got, want)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	var sb strings.Builder
+	for i := 0; sb.Len() < 1<<18; i++ {
+		fmt.Fprintf(&sb, "line %d: mail%d@example.com aab%s\n", i, i%7, strings.Repeat("a", i%13))
+	}
+	data := []byte(sb.String())
+	for _, re := range []Regexp{
+		MustCompile(`(\w+)@(\w+)\.com`),
+		MustCompile(`^line \d+`),
+		MustCompile(`(?m)^line (\d+)`),
+		MustCompile(`a*`),
+		MustCompile(`(?s)a{3}.{20}`),
+		mustCompile(`(\w+)@(\w+)\.com`),
+		mustCompile(`(?m)^(?=line)`),
+		mustCompile(`(?<=@)\w+`),
+		mustCompile(`(?s)a{3}.{20}`),
+		mustCompile(`(?s)(ab?){2,}.*?$`),
+	} {
+		for _, n := range []int{-1, 0, 7} {
+			want := re.FindAllSubmatchIndex(data, n)
+			if got := re.FindAllSubmatchIndexParallel(data, n); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindAllSubmatchIndexParallel(%d) = %d matches, want %d", re, n, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(2)
+	a1, _ := c.Compile(`a+`)
+	c.Compile(`b+`)
+	if a2, _ := c.Compile(`a+`); a2 != a1 {
+		t.Errorf("Compile(`a+`) did not return the cached Regexp")
+	}
+	c.Compile(`c+`) // evicts b+, the least recently used
+	if _, err := c.Compile(`(`); err == nil {
+		t.Errorf("Compile(`(`) should fail")
+	}
+	if _, err := c.Compile(`(`); err == nil {
+		t.Errorf("cached Compile(`(`) should fail")
+	}
+	if f, _ := c.CompileFreeSpacing(`a + # comment`); !f.MatchString("aa") {
+		t.Errorf("CompileFreeSpacing(`a + # comment`) does not match aa")
+	}
+	want := CacheStats{Hits: 2, Misses: 5, Evictions: 3, Len: 2, Size: 2}
+	if s := c.Stats(); s != want {
+		t.Errorf("Stats() = %+v, want %+v", s, want)
+	}
+
+	c.Purge()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				exp := fmt.Sprintf("x{%d}", (g+i)%3+1)
+				if re, err := c.Compile(exp); err != nil || !re.MatchString("xxx") {
+					t.Errorf("Compile(%#q) = %v, %v", exp, re, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if s := c.Stats(); s.Hits+s.Misses != 2+5+800 || s.Len != 2 {
+		t.Errorf("Stats() = %+v after concurrent use", s)
+	}
+}
+
+func TestAll(t *testing.T) {
+	for _, exp := range []string{`a(b*)|x`, `a(b*)|x(?=)`} {
+		r := MustCompile(exp)
+		var got [][]int
+		for m := range r.All([]byte("abbxab")) {
+			got = append(got, matchLoc(m, r.NumSubexp()))
+			if start, end := m.Span(); m.String() != "abbxab"[start:end] {
+				t.Errorf("%#q.All() yielded %q at %d, %d", exp, m.String(), start, end)
+			}
+		}
+		if want := r.FindAllSubmatchIndex([]byte("abbxab"), -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.All() = %v, want %v", exp, got, want)
+		}
+	}
+
+	// Matches are only searched for as the iteration proceeds.
+	calls := 0
+	r := mustCompile(`a(?{count})`)
+	r.Funcs(syntax.FuncMap{
+		"count": func(ctx syntax.Context) interface{} {
+			calls++
+			return 0
+		},
+	})
+	for m := range r.AllString(strings.Repeat("a", 1000)) {
+		if m.Index() == 2 {
+			break
+		}
+	}
+	if calls != 3 {
+		t.Errorf("breaking after 3 matches ran %d callouts, want 3", calls)
+	}
+}
+
+// matchLoc returns the index pairs of m and its n groups, as returned by
+// FindSubmatchIndex.
+func matchLoc(m *syntax.Match, n int) []int {
+	loc := make([]int, 0, 2*(n+1))
+	for i := 0; i <= n; i++ {
+		start, end, _ := m.GroupSpan(i)
+		loc = append(loc, start, end)
+	}
+	return loc
+}
+
+func TestMatch(t *testing.T) {
+	const text = "on 2024-05 and 2023-01-02"
+	for _, exp := range []string{
+		`(?P<year>\d{4})-(?P<month>\d\d)(-(?P<day>\d\d))?`,
+		`(?P<year>\d{4})-(?P<month>\d\d)(-(?P<day>\d\d))?(?=)`,
+	} {
+		re := MustCompile(exp)
+		b := []byte(text)
+		m := re.FindMatch(b)
+		copy(b, "xxxxxxxxxx") // the match keeps its own copy
+		if start, end := m.Span(); start != 3 || end != 10 || m.String() != "2024-05" {
+			t.Errorf("%#q: Span() = %d, %d, String() = %q", exp, start, end, m.String())
+		}
+		if g, ok := m.Group(2); g != "05" || !ok {
+			t.Errorf("%#q: Group(2) = %q, %v", exp, g, ok)
+		}
+		if g, ok := m.Named("day"); g != "" || ok || m.Matched(3) || m.Matched(5) || m.Matched(-1) {
+			t.Errorf("%#q: unmatched day reported as %q, %v", exp, g, ok)
+		}
+		if start, end, ok := m.GroupSpan(4); start != -1 || end != -1 || ok {
+			t.Errorf("%#q: GroupSpan(4) = %d, %d, %v", exp, start, end, ok)
+		}
+		if nm := m.NamedMap(); !reflect.DeepEqual(nm, map[string]string{"year": "2024", "month": "05"}) {
+			t.Errorf("%#q: NamedMap() = %v", exp, nm)
+		}
+		if e := m.Expand("$month/${year}[$day]"); e != "05/2024[]" {
+			t.Errorf("%#q: Expand() = %q", exp, e)
+		}
+
+		all := re.FindAllStringMatches(text, -1)
+		if len(all) != 2 {
+			t.Fatalf("%#q: FindAllStringMatches() = %v", exp, all)
+		}
+		if g, ok := all[1].Named("day"); g != "02" || !ok {
+			t.Errorf("%#q: second Named(day) = %q, %v", exp, g, ok)
+		}
+		if start, end, _ := all[1].GroupSpan(3); start != 22 || end != 25 {
+			t.Errorf("%#q: second GroupSpan(3) = %d, %d", exp, start, end)
+		}
+		if all[1].Index() != 1 {
+			t.Errorf("%#q: second Index() = %d", exp, all[1].Index())
+		}
+		if re.FindStringMatch("none") != nil || re.FindAllMatches([]byte("none"), -1) != nil {
+			t.Errorf("%#q: found a match in %q", exp, "none")
+		}
+	}
+
+}
+
+func TestReplaceAllSubmatchFunc(t *testing.T) {
+	const text = "on 2024-05 and 2023-01-02."
+	for _, exp := range []string{
+		`(?P<year>\d{4})-(?P<month>\d\d)(-(?P<day>\d\d))?`,
+		`(?P<year>\d{4})-(?P<month>\d\d)(-(?P<day>\d\d))?(?=)`,
+	} {
+		re := MustCompile(exp)
+		repl := func(m *syntax.Match) string {
+			src, offset := m.Source()
+			_, end := m.Span()
+			day, ok := m.Named("day")
+			if !ok {
+				day = "??"
+			}
+			return fmt.Sprintf("%d:%s.%s.%s%.1s", m.Index(), day, m.Expand("$month"), m.Expand("$year"), src[end-offset:])
+		}
+		want := "on 0:??.05.2024  and 1:02.01.2023.."
+		if got := re.ReplaceAllStringSubmatchFunc(text, repl); got != want {
+			t.Errorf("%#q.ReplaceAllStringSubmatchFunc() = %q, want %q", exp, got, want)
+		}
+		got := re.ReplaceAllSubmatchFunc([]byte(text), func(m *syntax.Match) []byte {
+			return []byte(repl(m))
+		})
+		if string(got) != want {
+			t.Errorf("%#q.ReplaceAllSubmatchFunc() = %q, want %q", exp, got, want)
+		}
+
+		errAbort := errors.New("abort")
+		calls := 0
+		res, err := re.ReplaceAllStringSubmatchFuncErr(text, func(m *syntax.Match) (string, error) {
+			calls++
+			if _, ok := m.Group(3); !ok {
+				return "", errAbort
+			}
+			return "x", nil
+		})
+		if res != "" || err != errAbort || calls != 1 {
+			t.Errorf("%#q.ReplaceAllStringSubmatchFuncErr() = %q, %v after %d calls, want the error after 1", exp, res, err, calls)
+		}
+		b, err := re.ReplaceAllSubmatchFuncErr([]byte(text), func(m *syntax.Match) ([]byte, error) {
+			return []byte(m.String()[:4]), nil
+		})
+		if string(b) != "on 2024 and 2023." || err != nil {
+			t.Errorf("%#q.ReplaceAllSubmatchFuncErr() = %q, %v", exp, b, err)
+		}
+		if b := re.ReplaceAllSubmatchFunc([]byte("none"), nil); string(b) != "none" {
+			t.Errorf("%#q.ReplaceAllSubmatchFunc(%q) = %q", exp, "none", b)
+		}
+	}
+}
+
+// endless is a RuneReader that returns the runes of s forever.
+type endless struct {
+	s string
+	i int
+}
+
+func (e *endless) ReadRune() (rune, int, error) {
+	r, size := utf8.DecodeRuneInString(e.s[e.i:])
+	e.i = (e.i + size) % len(e.s)
+	return r, size, nil
+}
+
+func TestReader(t *testing.T) {
+	text := strings.Repeat("x", 1<<20) + "abc" + strings.Repeat("y", 1<<16)
+	for _, c := range []struct {
+		exp  string
+		want []int
+	}{
+		{`(?<=x)abc`, []int{1 << 20, 1<<20 + 3}},
+		{`(?<=xxx)a(b)(?=cy)`, []int{1 << 20, 1<<20 + 2, 1<<20 + 1, 1<<20 + 2}},
+		{`\bab(c)`, nil},
+		{`c(y+)$`, []int{1<<20 + 2, len(text), 1<<20 + 3, len(text)}},
+		{`(?i)Y\z`, []int{len(text) - 1, len(text)}},
+		{`x(?>ab|a)(c)`, []int{1<<20 - 1, 1<<20 + 3, 1<<20 + 2, 1<<20 + 3}},
+	} {
+		re := mustCompile(c.exp)
+		if got := re.FindReaderSubmatchIndex(strings.NewReader(text)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%#q.FindReaderSubmatchIndex() = %v, want %v", c.exp, got, c.want)
+		}
+	}
+
+	// Matching stops reading once the result is known.
+	if !mustCompile(`(?<=b)c+a`).MatchReader(&endless{s: "abcca"}) {
+		t.Errorf("MatchReader on an endless stream did not match")
+	}
+	loc := mustCompile(`é+`).FindReaderIndex(&endless{s: "aéé"})
+	if want := []int{1, 5}; !reflect.DeepEqual(loc, want) {
+		t.Errorf("FindReaderIndex on an endless stream = %v, want %v", loc, want)
+	}
+}
+
+// flushReader returns n copies of chunk, and checks before each read
+// that all but the last chunk of the text read has been written to w.
+type flushReader struct {
+	t     *testing.T
+	w     *bytes.Buffer
+	chunk []byte
+	n     int
+	rest  []byte
+	read  int
+}
+
+func (f *flushReader) Read(p []byte) (int, error) {
+	if f.w.Len() < f.read-len(f.chunk) {
+		f.t.Fatalf("%d bytes written after reading %d", f.w.Len(), f.read)
+	}
+	if len(f.rest) == 0 {
+		if f.n == 0 {
+			return 0, io.EOF
+		}
+		f.n--
+		f.rest = f.chunk
+	}
+	k := copy(p, f.rest)
+	f.rest = f.rest[k:]
+	f.read += k
+	return k, nil
+}
+
+func TestReplaceReader(t *testing.T) {
+	for _, c := range []struct {
+		exp, src, repl string
+	}{
+		{`a(b*)`, "xabbyaz", "<$1>"},
+		{`(?<=a)b|x*`, "abcxxb\xffé", "[$0]"},
+		{`^a|b$`, "aab\nab", "-"},
+		{`(?i)é+`, "aÉé\xc3", "e"},
+	} {
+		for _, exp := range []string{c.exp, c.exp + `(?=)`} {
+			re := MustCompile(exp)
+			want := re.ReplaceAllString(c.src, c.repl)
+			var w strings.Builder
+			if err := re.ReplaceReader(&w, iotest.OneByteReader(strings.NewReader(c.src)), []byte(c.repl)); err != nil || w.String() != want {
+				t.Errorf("%#q.ReplaceReader(%q) = %q, %v, want %q", exp, c.src, w.String(), err, want)
+			}
+			want = re.ReplaceAllStringFunc(c.src, strings.ToUpper)
+			w.Reset()
+			if err := re.ReplaceReaderFunc(&w, strings.NewReader(c.src), bytes.ToUpper); err != nil || w.String() != want {
+				t.Errorf("%#q.ReplaceReaderFunc(%q) = %q, %v, want %q", exp, c.src, w.String(), err, want)
+			}
+		}
+	}
+
+	// Text is written as soon as it cannot be part of a match.
+	for _, exp := range []string{`b+`, `(?<=x)b+`} {
+		var w bytes.Buffer
+		src := &flushReader{t: t, w: &w, chunk: bytes.Repeat([]byte("xxxxxxxb"), 1<<13), n: 16}
+		if err := MustCompile(exp).ReplaceReader(&w, src, []byte("c")); err != nil {
+			t.Fatal(err)
+		}
+		if want := src.read; w.Len() != want || bytes.IndexByte(w.Bytes(), 'b') >= 0 {
+			t.Errorf("%#q.ReplaceReader wrote %d bytes, want %d without b", exp, w.Len(), want)
+		}
+	}
+
+	errWrite := errors.New("write error")
+	err := MustCompile(`a`).ReplaceReader(io.Discard, iotest.TimeoutReader(strings.NewReader("aaa")), nil)
+	if err != iotest.ErrTimeout {
+		t.Errorf("ReplaceReader with a failing reader = %v, want %v", err, iotest.ErrTimeout)
+	}
+	err = MustCompile(`a`).ReplaceReader(errWriter{errWrite}, strings.NewReader("xax"), nil)
+	if err != errWrite {
+		t.Errorf("ReplaceReader with a failing writer = %v, want %v", err, errWrite)
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
 func BenchmarkAny(b *testing.B) {
 	data, err := getBenchmarkData()
 	if err != nil {
@@ -358,3 +1146,315 @@ func BenchmarkURLBuiltin(b *testing.B) {
 		r.FindAllSubmatchIndex(data, -1)
 	}
 }
+
+func BenchmarkFoldLiteral(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := mustCompile(`(?i)arthur`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+func BenchmarkFoldLiteralBuiltin(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := MustCompile(`(?i)arthur`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+func BenchmarkRequiredLiteral(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := mustCompile(`[ァ-ヶー]{1,8}王`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+func BenchmarkRequiredLiteralBuiltin(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := MustCompile(`[ァ-ヶー]{1,8}王`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+// A regular part that ends the expression is run by the built-in engine.
+// Followed by a lookahead, which does not decide where it ends, the same
+// part is backtracked.
+func BenchmarkDelegatedTail(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := mustCompile(`(?:[ぁ-ゖ]+|ー)+、`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+func BenchmarkDelegatedNonTail(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := mustCompile(`(?:[ぁ-ゖ]+|ー)+、(?=.)`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndex(data, -1)
+	}
+}
+
+// The regular part before the back reference ends where the reference
+// can start, so it is not backtracked into, and the search skips the
+// positions where it does not match. The time grows linearly with the
+// text.
+func BenchmarkDelegatedRun(b *testing.B) {
+	r := mustCompile(`(\w+)\s+\k1`)
+	for _, n := range []int{1 << 10, 1 << 14, 1 << 18} {
+		data := []byte(strings.Repeat("a", n))
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r.Match(data)
+			}
+		})
+	}
+}
+
+func BenchmarkCountAll(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := mustCompile(`アーサー`)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.CountAll(data, -1)
+	}
+}
+
+func BenchmarkCountAllBuiltin(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := MustCompile(`アーサー`)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.CountAll(data, -1)
+	}
+}
+
+func BenchmarkAppendAllStringIndex(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := string(data)
+	r := mustCompile(`[ぁ-ゖ]+`)
+	dst := r.AppendAllStringIndex(nil, s, -1)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dst = r.AppendAllStringIndex(dst[:0], s, -1)
+	}
+}
+
+func BenchmarkAppendAllStringIndexBuiltin(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := string(data)
+	r := MustCompile(`[ぁ-ゖ]+`)
+	dst := r.AppendAllStringIndex(nil, s, -1)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dst = r.AppendAllStringIndex(dst[:0], s, -1)
+	}
+}
+
+func BenchmarkParallelSubmatch(b *testing.B) {
+	r := mustCompile(`(\w+)@(\w+)\.com(?=\s)`)
+	data := []byte(strings.Repeat("some text ", 20) + "mail@example.com ")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		dst := make([]int, 0, 6)
+		for pb.Next() {
+			dst = r.AppendSubmatchIndex(dst[:0], data)
+		}
+	})
+}
+
+func BenchmarkFindAllParallel(b *testing.B) {
+	data, err := getBenchmarkData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data = bytes.Repeat(data, 8)
+	r := mustCompile(`(?<=「)[^」]+`)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.FindAllSubmatchIndexParallel(data, -1)
+	}
+}
+
+func BenchmarkMatchString(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		MatchString(`^(\w+)@(\w+)\.com$`, "mail@example.com")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	const src = "..xzw.."
+	g := gre.MustCompile(`(?P<a>x)(?P<b1>y)?(z)(?P<a>w)?`)
+	for _, exp := range []string{g.String(), g.String() + `(?=)`} {
+		re := MustCompile(exp)
+		match := re.FindStringSubmatchIndex(src)
+		for _, template := range []string{"", "$a[$b1]${3}$$", "$4x ${4}x $1x $a_$", "${a", "$01 ${é} $", "é$3é"} {
+			want := g.ExpandString([]byte("dst:"), template, src, match)
+			if got := re.ExpandString([]byte("dst:"), template, src, match); string(got) != string(want) {
+				t.Errorf("%#q.ExpandString(%q) = %q, want %q", exp, template, got, want)
+			}
+			if got := re.Expand([]byte("dst:"), []byte(template), []byte(src), match); string(got) != string(want) {
+				t.Errorf("%#q.Expand(%q) = %q, want %q", exp, template, got, want)
+			}
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	const text = "ab Éric-dupont, zoë"
+	for template, want := range map[string]string{
+		`[$&|\0|$1|${2}|$$|\$|\\]`:            "[Éric-dupont|Éric-dupont|Éric|dupont|$|$|\\], [zoë|zoë|zoë||$|$|\\]",
+		`\U$1\E-\L$1\E-\u$2\l$1`:              "ÉRIC-éric-Dupontéric, ZOË-zoë-zoë",
+		`\u\L$first \U${last}`:                "Éric DUPONT, Zoë ",
+		`${last:+$last\, $first:$first only}`: "dupont, Éric, zoë only",
+		`${last:+has last}${2:-\U$1}`:         "has lastdupont, ZOË",
+		`${nosuch:-none}${9:+x:y}\: \}`:       "noney: }, noney: }",
+	} {
+		tmpl, err := CompileTemplate(template)
+		if err != nil {
+			t.Errorf("CompileTemplate(%#q) error = %v", template, err)
+			continue
+		}
+		for _, exp := range []string{`(?P<first>\pL+)(?:-(?P<last>\pL+))?`, `(?P<first>\pL+)(?:-(?P<last>\pL+))?(?=)`} {
+			re := MustCompile(exp)
+			if got := re.ReplaceAllStringTemplate(text[3:], tmpl); got != want {
+				t.Errorf("%#q.ReplaceAllStringTemplate(%#q) = %q, want %q", exp, template, got, want)
+			}
+			if got := re.ReplaceAllTemplate([]byte(text[3:]), tmpl); string(got) != want {
+				t.Errorf("%#q.ReplaceAllTemplate(%#q) = %q, want %q", exp, template, got, want)
+			}
+			// Matches of the Find methods only hold the matched text.
+			m := re.FindAllStringMatches(text, -1)[1]
+			first := "dst:" + re.ReplaceAllStringTemplate(m.String(), tmpl)
+			if got := string(m.AppendTemplate([]byte("dst:"), tmpl)); got != first {
+				t.Errorf("%#q: AppendTemplate(%#q) = %q, want %q", exp, template, got, first)
+			}
+		}
+	}
+
+	for template, expr := range map[string]string{
+		`a\`:          `\`,
+		`a\qb`:        `\q`,
+		`$`:           `$`,
+		`x$.`:         `$`,
+		`${1`:         `${1`,
+		`${}`:         `${}`,
+		`${1:x}`:      `${1:`,
+		`${1:+a:b:c}`: `${1:+a:b:`,
+		`é${1:-a`:     `${1:-a`,
+		`\é`:          `\é`,
+	} {
+		_, err := CompileTemplate(template)
+		var e *syntax.Error
+		if !errors.As(err, &e) || e.Code != syntax.ErrInvalidTemplate || e.Expr != expr || e.Offset != strings.Index(template, expr) {
+			t.Errorf("CompileTemplate(%#q) error = %v, want %#q", template, err, expr)
+		}
+	}
+}
+
+func TestPreserveCase(t *testing.T) {
+	for _, c := range []struct{ model, s, want string }{
+		{"foo", "Bar", "bar"},
+		{"Foo", "bar", "Bar"},
+		{"FOO", "barBaz", "BARBAZ"},
+		{"F", "bar", "Bar"},
+		{"fooBar", "Baz", "baz"},
+		{"FooBar", "bazQux", "BazQux"},
+		{"123", "Bar", "Bar"},
+		{"Foo-BAR", "baz_qux", "Baz_QUX"},
+		{"Foo-BAR", "baz", "Baz"},
+		{"Ёлка", "дерево", "Дерево"},
+		{"ЁЛКА", "дерево", "ДЕРЕВО"},
+		{"Foo", "ǆem", "ǅem"},
+		{"Éa", " 1ée", " 1Ée"},
+	} {
+		if got := syntax.PreserveCase(c.model, c.s); got != c.want {
+			t.Errorf("PreserveCase(%q, %q) = %q, want %q", c.model, c.s, got, c.want)
+		}
+	}
+
+	const text = "foo Foo FOO fooBar FooBar_FOO ёлка ЁЛКА"
+	for _, exp := range []string{`(?i)foo|ёлка`, `(?i)(?:foo|ёлка)(?=)`} {
+		re := MustCompile(exp)
+		want := "bar Bar BAR barBar BarBar_BAR bar BAR"
+		if got := re.ReplaceAllStringPreserveCase(text, "bar"); got != want {
+			t.Errorf("%#q.ReplaceAllStringPreserveCase() = %q, want %q", exp, got, want)
+		}
+		if got := re.ReplaceAllPreserveCase([]byte(text), []byte("bar")); string(got) != want {
+			t.Errorf("%#q.ReplaceAllPreserveCase() = %q, want %q", exp, got, want)
+		}
+	}
+
+	tmpl := MustCompileTemplate(`${1:~new}${2:~$2-x}`)
+	re := MustCompile(`(?i)(old)(_\w+)?`)
+	if got, want := re.ReplaceAllStringTemplate("old OLD_NAME Old_name", tmpl), "new-x NEW_NAME-X New_name-x"; got != want {
+		t.Errorf("%#q.ReplaceAllStringTemplate(%#q) = %q, want %q", re, tmpl, got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package syntax
+
+// analysis holds the properties of a node that the compiler, the
+// prefilter and the matcher query repeatedly. It is computed once by
+// analyze for the groups, repetitions and alternations of the tree, so
+// that querying a node does not walk its subtree again.
+type analysis struct {
+	min, max int
+
+	// nullable is set if the node can match the empty string.
+	nullable bool
+
+	// prefix is the literal prefix of the matches of the node, complete if
+	// it is the whole match.
+	prefix   []byte
+	complete bool
+
+	// fixed is set if matches can only start at the beginning of the text.
+	// It is only computed for groups.
+	fixed bool
+}
+
+// newAnalysis computes the analysis of n, whose children have theirs.
+func newAnalysis(n node) *analysis {
+	a := &analysis{}
+	a.min, a.max = n.MinMax()
+	a.nullable = a.min == 0
+	a.prefix, a.complete = n.LiteralPrefix()
+	return a
+}
+
+// analyze computes the analysis of every group, repetition and alternation
+// of n, innermost first, and returns the resulting tree.
+func analyze(n node) node {
+	switch e := n.(type) {
+	case groupNode:
+		for i, c := range e.N {
+			e.N[i] = analyze(c)
+		}
+		a := newAnalysis(e)
+		a.fixed = fixedBeginning(e)
+		e.a = a
+		return e
+	case alterNode:
+		for i, c := range e.N {
+			if c != nil {
+				e.N[i] = analyze(c)
+			}
+		}
+		e.a = newAnalysis(e)
+		return e
+	case repeatNode:
+		e.N = analyze(e.N)
+		e.a = newAnalysis(e)
+		return e
+	case lookaheadNode:
+		e.N = analyze(e.N)
+		return e
+	case lookbehindNode:
+		e.N = analyze(e.N)
+		return e
+	}
+	return n
+}
+
+// fixedBeginning reports whether the matches of n can only start at
+// the beginning of the text.
+func fixedBeginning(n node) bool {
+	b, _ := n.Hint()[hintFixedBeginning].(bool)
+	return b
+}
+
+// nullable reports whether n can match the empty string.
+func nullable(n node) bool {
+	switch e := n.(type) {
+	case groupNode:
+		if e.a != nil {
+			return e.a.nullable
+		}
+	case alterNode:
+		if e.a != nil {
+			return e.a.nullable
+		}
+	case repeatNode:
+		if e.a != nil {
+			return e.a.nullable
+		}
+	}
+	min, _ := n.MinMax()
+	return min == 0
+}
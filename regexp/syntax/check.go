@@ -0,0 +1,131 @@
+package syntax
+
+import (
+	"regexp/syntax"
+	"slices"
+)
+
+// Codes of the warnings reported by Check.
+const (
+	WarnEmptyAlternative syntax.ErrorCode = "empty alternative"
+	WarnNestedQuantifier syntax.ErrorCode = "nested quantifier"
+)
+
+// Severity tells whether a Diagnostic makes the expression invalid.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found by Check, at the position given by its
+// Error.
+type Diagnostic struct {
+	Severity Severity
+	*Error
+}
+
+func (d Diagnostic) String() string {
+	return d.Severity.String() + ": " + d.Code.String() + ": `" + d.Expr + "`"
+}
+
+// CheckOptions selects what Check reports.
+type CheckOptions struct {
+	// Warnings enables the reports of suspicious constructs, which are
+	// valid but are unlikely to do what was meant.
+	Warnings bool
+}
+
+// Check parses expr and reports all its problems in the order of their
+// positions, where Compile reports the first error only. After an error
+// the parsing goes on after the offending text, so an error can hide
+// another one within that text. An expression without extended syntax
+// is also checked by the built-in parser, whose first error is reported.
+func Check(expr string, opts CheckOptions) []Diagnostic {
+	p := parser{check: true, warnings: opts.Warnings}
+	n, _, err := p.parse([]byte(expr), syntax.OneLine|syntax.PerlX)
+	if e, ok := err.(*Error); ok {
+		// Only invalid UTF-8 stops the parsing.
+		return []Diagnostic{{Severity: SeverityError, Error: e}}
+	}
+	if n != nil && !n.IsExtended() && !slices.ContainsFunc(p.diags, isError) {
+		if e := builtinError(expr); e != nil {
+			p.diags = append(p.diags, Diagnostic{Severity: SeverityError, Error: e})
+		}
+	}
+	slices.SortStableFunc(p.diags, func(a, b Diagnostic) int {
+		return a.RuneOffset - b.RuneOffset
+	})
+	return p.diags
+}
+
+// backrefUse is a back reference, by name or index, at the runes of the
+// pattern from start to end.
+type backrefUse struct {
+	name       string
+	index      int
+	start, end int
+}
+
+// defined reports whether the group referred to by b exists.
+func (p *parser) defined(b backrefUse) bool {
+	if b.name == "" {
+		return b.index > 0 && b.index < len(p.subexpNames)
+	}
+	return slices.Index(p.subexpNames, b.name) > 0
+}
+
+// recovery is the panic value of a failure in check mode. It holds the
+// offset in the pattern after the offending text.
+type recovery int
+
+// try calls f and returns -1, or in check mode the offset after the error
+// that ended f.
+func (p *parser) try(f func()) (resume int) {
+	if p.check {
+		defer func() {
+			if r := recover(); r != nil {
+				rc, ok := r.(recovery)
+				if !ok {
+					panic(r)
+				}
+				resume = int(rc)
+			}
+		}()
+	}
+	f()
+	return -1
+}
+
+func isError(d Diagnostic) bool {
+	return d.Severity == SeverityError
+}
+
+func isAlter(n node) bool {
+	_, ok := n.(alterNode)
+	return ok
+}
+
+// hasRepeat reports whether n repeats a part of its text more than once
+// and can give it back when backtracking.
+func hasRepeat(n node) bool {
+	switch n := n.(type) {
+	case groupNode:
+		return !n.Atomic && slices.ContainsFunc(n.N, hasRepeat)
+	case alterNode:
+		return slices.ContainsFunc(n.N, hasRepeat)
+	case repeatNode:
+		return !n.Atomic && (n.Max < 0 || n.Max > 1) || hasRepeat(n.N)
+	case anyCharRepeatNode:
+		return !n.Atomic && (n.Max < 0 || n.Max > 1)
+	}
+	return false
+}
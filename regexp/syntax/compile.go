@@ -0,0 +1,353 @@
+package syntax
+
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+)
+
+type opcode uint8
+
+const (
+	opMatch        opcode = iota // end of the program or of a sub-program
+	opSplit                      // continue at x, backtrack to y
+	opJmp                        // continue at x
+	opLiteral                    // match lit
+	opChar                       // match a rune
+	opRepeatRune                 // match min to max runes of a class
+	opBegin                      // assert the beginning of text or line
+	opEnd                        // assert the end of text or line
+	opWordBoundary               // assert a word boundary
+	opBackRef                    // match the text of a capture
+	opGroupStart                 // remember where a capture starts
+	opGroupEnd                   // store a capture
+	opLoopInit                   // remember where the first iteration starts
+	opLoopMark                   // remember where the next iteration starts
+	opLoopCheck                  // reject an empty iteration after the first
+	opCountInit                  // reset the iteration counter of a bounded loop
+	opCount                      // run another iteration at the next instruction or exit to x
+	opCountNext                  // count an iteration and continue at x
+	opAtomic                     // run a sub-program, keep its first match
+	opLookahead                  // run a sub-program at the current position
+	opLookbehind                 // run a sub-program ending at the current position
+	opCall                       // call an inline function
+	opDelegate                   // match with the built-in engine, or fall through
+)
+
+// inst is a single instruction of a program.
+// Unless stated otherwise an instruction continues at the next one.
+type inst struct {
+	op opcode
+
+	// x and y are jump targets. Sub-program instructions continue at x,
+	// the sub-program itself starts at the next instruction.
+	x, y int
+
+	// arg is the capture index, the loop register, the counter or the
+	// index of the called function in prog.calls.
+	arg int
+
+	min, max   int
+	lazy       bool
+	possessive bool
+	negative   bool
+	line       bool
+
+	flags    syntax.Flags
+	lit      []byte
+	matcher  runeMatcher
+	delegate *delegate
+
+	// memo is set on instructions where explored states are recorded, and
+	// counters holds the registers of the bounded loops enclosing them.
+	// cycle is set on the memo points of a loop whose body can match
+	// empty. As in Go, their states are explored at most once per search,
+	// so that an iteration coming back to a state without consuming text
+	// ends there.
+	memo     bool
+	cycle    bool
+	counters []int
+}
+
+// runeMatcher matches a single rune; it is implemented by the nodes
+// that consume exactly one rune.
+type runeMatcher interface {
+	matchRune(r rune) bool
+}
+
+// prog is a compiled regular expression.
+type prog struct {
+	inst []inst
+
+	// ncap is the number of capturing groups including the whole match.
+	ncap int
+
+	// nslot is the size of the slot array: two slots per capture, one
+	// start slot per capture and one register per loop.
+	// A loop register holds the start of the current iteration,
+	// encoded by firstIteration for the first one, or the number of
+	// iterations of a bounded loop.
+	nslot int
+
+	subexpNames []string
+	subexpMap   map[string]int
+
+	// calls are the names of the inline functions called by the program.
+	calls []string
+
+	// needCaps is set if matching reads the captures, through back
+	// references or inline functions.
+	needCaps bool
+
+	// behind is the number of bytes before the start of a match that
+	// lookbehind assertions can read.
+	behind int
+
+	// lead finds the matches of a regular subtree that starts every match
+	// of the program, or is nil. The subtree is compiled as a single
+	// instruction, a delegate or an atomic group, so that a failed attempt
+	// tells whether it matched.
+	lead *stdregexp.Regexp
+}
+
+// pending returns the slot that holds the start of capture i
+// until the capture is complete.
+func (p *prog) pending(i int) int {
+	return p.ncap*2 + i
+}
+
+type compiler struct {
+	p        *prog
+	loops    []int
+	counters []int
+
+	// groups holds the capturing groups of the program by index.
+	groups []node
+
+	// tail is set while compiling a node that ends its program, and depth
+	// is the number of sub-programs enclosing it.
+	tail  bool
+	depth int
+
+	// memoNext marks the next emitted instruction as a memo point.
+	memoNext bool
+}
+
+func compile(root node, subexpNames []string, subexpMap map[string]int) *prog {
+	c := &compiler{
+		p: &prog{
+			ncap:        len(subexpNames),
+			nslot:       len(subexpNames) * 3,
+			subexpNames: subexpNames,
+			subexpMap:   subexpMap,
+		},
+		groups: make([]node, len(subexpNames)),
+		tail:   true,
+	}
+	collectGroups(root, c.groups)
+	root.compile(c)
+	c.emit(inst{op: opMatch})
+	for _, i := range c.p.inst {
+		if i.op == opBackRef || i.op == opCall {
+			c.p.needCaps = true
+		}
+		if i.op == opLookbehind {
+			c.p.behind += i.max
+		}
+	}
+	markMemo(c.p)
+	return c.p
+}
+
+// collectGroups stores the capturing groups of n in groups by index.
+func collectGroups(n node, groups []node) {
+	switch e := n.(type) {
+	case groupNode:
+		if e.Index > 0 {
+			groups[e.Index] = e
+		}
+		for _, c := range e.N {
+			collectGroups(c, groups)
+		}
+	case alterNode:
+		for _, c := range e.N {
+			collectGroups(c, groups)
+		}
+	case repeatNode:
+		collectGroups(e.N, groups)
+	case lookaheadNode:
+		collectGroups(e.N, groups)
+	case lookbehindNode:
+		collectGroups(e.N, groups)
+	}
+}
+
+// pc returns the index of the next emitted instruction.
+func (c *compiler) pc() int {
+	return len(c.p.inst)
+}
+
+func (c *compiler) emit(i inst) int {
+	if i.op == opSplit || i.op == opCount || c.memoNext {
+		i.memo = true
+		i.cycle = len(c.loops) > 0
+		i.counters = append([]int(nil), c.counters...)
+		c.memoNext = false
+	}
+	c.p.inst = append(c.p.inst, i)
+	return len(c.p.inst) - 1
+}
+
+// register allocates a loop register.
+func (c *compiler) register() int {
+	c.p.nslot++
+	return c.p.nslot - 1
+}
+
+// sub compiles n as a sub-program introduced by i.
+func (c *compiler) sub(i inst, n node) {
+	pc := c.emit(i)
+	loops, counters, tail := c.loops, c.counters, c.tail
+	c.loops, c.counters = nil, nil
+	c.tail = i.op != opLookbehind
+	c.depth++
+	n.compile(c)
+	c.emit(inst{op: opMatch})
+	c.depth--
+	c.loops, c.counters, c.tail = loops, counters, tail
+	c.p.inst[pc].x = c.pc()
+}
+
+// split emits a split whose branches are set later by patch.
+func (c *compiler) split(lazy bool) int {
+	return c.emit(inst{op: opSplit, lazy: lazy})
+}
+
+// patch sets the branches of the split at pc.
+// body is tried first unless the split is lazy.
+func (c *compiler) patch(pc int, body, exit int) {
+	i := &c.p.inst[pc]
+	if i.lazy {
+		i.x, i.y = exit, body
+	} else {
+		i.x, i.y = body, exit
+	}
+}
+
+// firstIteration encodes the start of the first iteration of a loop.
+func firstIteration(pos int) int {
+	return -2 - pos
+}
+
+// star compiles n*, or n+ if plus is set.
+//
+// Empty iterations follow Go: the states of the body are cycle points, so
+// an iteration coming back to a state explored at the same position ends
+// there, and the loop goes on with what the earlier iterations matched.
+// Where back references or inline functions keep states from being
+// recorded, an empty first iteration ends the loop and an empty iteration
+// after the first one is rejected.
+func (c *compiler) star(n node, lazy, plus bool) {
+	nullable := nullable(n)
+	if !nullable && !plus {
+		// As in Go, entering the loop and iterating share a split.
+		loop := c.split(lazy)
+		n.compile(c)
+		c.emit(inst{op: opJmp, x: loop})
+		c.patch(loop, loop+1, c.pc())
+		return
+	}
+
+	enter := -1
+	if !plus {
+		enter = c.split(lazy)
+	}
+	r := -1
+	if nullable {
+		r = c.register()
+		c.emit(inst{op: opLoopInit, arg: r})
+		c.loops = append(c.loops, r)
+	}
+	body := c.pc()
+	n.compile(c)
+	if nullable {
+		c.emit(inst{op: opLoopCheck, arg: r})
+	}
+	loop := c.split(lazy)
+	next := c.pc()
+	if nullable {
+		c.emit(inst{op: opLoopMark, arg: r})
+		c.loops = c.loops[:len(c.loops)-1]
+	}
+	c.emit(inst{op: opJmp, x: body})
+	exit := c.pc()
+	c.patch(loop, next, exit)
+	if enter >= 0 {
+		c.patch(enter, enter+1, exit)
+	}
+}
+
+// repeatRune compiles the repetition of a single rune matched by m.
+// Inside a loop whose body can match empty, the repetition is compiled
+// as a loop of its own, so that its states are cycle points.
+func (c *compiler) repeatRune(m runeMatcher, min, max int, lazy, possessive bool) {
+	if len(c.loops) > 0 && !possessive {
+		c.repeat(m.(node), min, max, lazy)
+		return
+	}
+	c.emit(inst{
+		op:         opRepeatRune,
+		min:        min,
+		max:        max,
+		lazy:       lazy,
+		possessive: possessive,
+		matcher:    m,
+	})
+	c.memoNext = true
+}
+
+// repeat compiles n{min,max}. Bounded iterations are counted, so the
+// program does not grow with the number of repetitions.
+func (c *compiler) repeat(n node, min, max int, lazy bool) {
+	if max < 0 {
+		if min == 0 {
+			c.star(n, lazy, false)
+			return
+		}
+		c.count(n, min-1, min-1, lazy)
+		c.star(n, lazy, true)
+		return
+	}
+	c.count(n, min, max, lazy)
+}
+
+// count compiles n{min,max} for a finite max. Empty iterations are
+// allowed, as if the repetition was unrolled.
+func (c *compiler) count(n node, min, max int, lazy bool) {
+	switch {
+	case max == 0:
+		return
+	case max == 1:
+		split := -1
+		if min == 0 {
+			split = c.split(lazy)
+		}
+		n.compile(c)
+		if split >= 0 {
+			c.patch(split, split+1, c.pc())
+		}
+		return
+	case min == max && min <= 2:
+		for i := 0; i < min; i++ {
+			n.compile(c)
+		}
+		return
+	}
+	r := c.register()
+	c.emit(inst{op: opCountInit, arg: r})
+	c.counters = append(c.counters, r)
+	loop := c.emit(inst{op: opCount, arg: r, min: min, max: max, lazy: lazy})
+	n.compile(c)
+	c.emit(inst{op: opCountNext, arg: r, x: loop})
+	c.counters = c.counters[:len(c.counters)-1]
+	c.p.inst[loop].x = c.pc()
+}
@@ -0,0 +1,651 @@
+package syntax
+
+import (
+	"io"
+	stdregexp "regexp"
+	"regexp/syntax"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// delegate runs a regular subtree with Go's built-in engine.
+//
+// The built-in engine only reports the preferred match, so a subtree is
+// delegated only where the backtracker would not ask for another one: at
+// the end of the program or of an atomic group or lookahead body, or
+// before text that decides where the subtree ends. In (\w+)\s+\k1 the
+// reference starts with a word character, so (\w+)\s+ can only be
+// followed by it once both loops have taken all they can.
+type delegate struct {
+	// re matches the subtree at the beginning of its input.
+	re *stdregexp.Regexp
+
+	// after matches the subtree after the rune preceding it, so that
+	// assertions see the left context. It is nil if the subtree has no
+	// assertion that depends on it.
+	after *stdregexp.Regexp
+
+	// caps maps the captures of re to the captures of the program.
+	caps []int
+
+	// first holds the bytes a match can start with, unless nullable is set.
+	first    [256]bool
+	nullable bool
+
+	// root is set if the subtree ends the whole program, where the
+	// longest mode needs every match.
+	root bool
+}
+
+// delegate compiles n as a delegated subtree followed by the regular code
+// for n, which is used when the delegate can not be.
+// It reports false if n does not end its program or is not worth
+// delegating.
+func (c *compiler) delegate(n node) bool {
+	if !c.tail || n.IsExtended() || !backtracks(n) {
+		return false
+	}
+	return c.emitDelegate(n)
+}
+
+// delegateRun compiles the regular nodes of run, which are followed by
+// rest, so that the backtracker does not come back into them. It reports
+// false if the text rest can start with does not decide where run ends,
+// or if run does not repeat anything.
+//
+// A run that backtracks is delegated, other runs are cheaper to match in
+// place as an atomic group with possessive loops.
+func (c *compiler) delegateRun(run, rest []node) bool {
+	g := groupNode{N: run}
+	var follow [256]bool
+	if !hasRepeat(g) || c.followBytes(rest, &follow) || !determined(g, &follow) {
+		return false
+	}
+	if c.pc() == 0 && c.depth == 0 {
+		c.p.lead = leadRegexp(g)
+	}
+	if backtracks(g) && c.emitDelegate(g) {
+		return true
+	}
+	c.sub(inst{op: opAtomic}, possessive(g))
+	return true
+}
+
+// possessive returns n with its loops made possessive, which keeps the
+// preferred match of n.
+func possessive(n node) node {
+	switch e := n.(type) {
+	case groupNode:
+		g := e
+		g.N = make([]node, len(e.N))
+		for i, c := range e.N {
+			g.N[i] = possessive(c)
+		}
+		return g
+	case alterNode:
+		a := alterNode{N: make([]node, len(e.N))}
+		for i, c := range e.N {
+			if c != nil {
+				a.N[i] = possessive(c)
+			}
+		}
+		return a
+	case repeatNode:
+		e.N = possessive(e.N)
+		e.Atomic = true
+		return e
+	case anyCharRepeatNode:
+		e.Atomic = true
+		return e
+	}
+	return n
+}
+
+// leadRegexp returns an unanchored built-in regexp for the regular subtree
+// n that starts every match, so that the search can skip the positions
+// where n does not match. It returns nil if n can match empty or looks at
+// the text before it.
+func leadRegexp(n node) *stdregexp.Regexp {
+	var caps []int
+	ok := true
+	re := toSyntax(n, &caps, &ok)
+	var first [256]bool
+	if !ok || firstBytes(n, &first) || needsContext(n) {
+		return nil
+	}
+	lead, err := stdregexp.Compile(re.String())
+	if err != nil {
+		return nil
+	}
+	return lead
+}
+
+// emitDelegate compiles n as a delegated subtree followed by the regular
+// code for n. It reports false if n can not be converted.
+func (c *compiler) emitDelegate(n node) bool {
+	var caps []int
+	ok := true
+	re := toSyntax(n, &caps, &ok)
+	if !ok {
+		return false
+	}
+	expr := re.String()
+	d := &delegate{caps: caps, root: c.tail && c.depth == 0}
+	d.nullable = firstBytes(n, &d.first)
+	var err error
+	if d.re, err = stdregexp.Compile(`^(?:` + expr + `)`); err != nil {
+		return false
+	}
+	if needsContext(n) {
+		if d.after, err = stdregexp.Compile(`^(?s:.)(?:` + expr + `)`); err != nil {
+			return false
+		}
+	}
+
+	pc := c.emit(inst{op: opDelegate, delegate: d})
+	tail := c.tail
+	c.tail = false
+	n.compile(c)
+	c.tail = tail
+	c.p.inst[pc].x = c.pc()
+	return true
+}
+
+// followBytes is firstBytes for the sequence ns. A back reference is known
+// to start like the group it refers to, unless it ignores case.
+func (c *compiler) followBytes(ns []node, set *[256]bool) bool {
+	for _, n := range ns {
+		if r, ok := n.(backRefNode); ok && r.Flags&syntax.FoldCase == 0 {
+			index := r.Index
+			if len(r.Name) > 0 {
+				index = c.p.subexpMap[r.Name]
+			}
+			if g := c.groups[index]; g != nil {
+				n = g
+			}
+		}
+		if !firstBytes(n, set) {
+			return false
+		}
+	}
+	return true
+}
+
+// determined reports whether n has at most one match that text starting
+// with a byte of follow can come after, and whether that match is the
+// preferred one. This holds if every loop of n runs over text that can
+// not start what comes after it, so that a shorter iteration would leave
+// text the rest can not match, and the branches of every alternation
+// start differently.
+func determined(n node, follow *[256]bool) bool {
+	switch e := n.(type) {
+	case groupNode:
+		f := *follow
+		for i := len(e.N) - 1; i >= 0; i-- {
+			if !determined(e.N[i], &f) {
+				return false
+			}
+			var first [256]bool
+			if !firstBytes(e.N[i], &first) {
+				f = [256]bool{}
+			}
+			for b, ok := range first {
+				f[b] = f[b] || ok
+			}
+		}
+		return true
+	case alterNode:
+		var seen [256]bool
+		for _, c := range e.N {
+			// The preferred match could take an empty branch where
+			// the rest needs another one.
+			var first [256]bool
+			if c == nil || firstBytes(c, &first) || !determined(c, follow) {
+				return false
+			}
+			for b, ok := range first {
+				if ok && seen[b] {
+					return false
+				}
+				seen[b] = seen[b] || ok
+			}
+		}
+		return true
+	case repeatNode:
+		return repeatDetermined(e.N, e.Min, e.Max, e.Reluctant, follow)
+	case anyCharRepeatNode:
+		return repeatDetermined(anyCharNode{Flags: e.Flags}, e.Min, e.Max, e.Reluctant, follow)
+	case literalNode, charNode, anyCharNode, beginNode, endNode, wordBoundaryNode:
+		return true
+	}
+	return false
+}
+
+func repeatDetermined(n node, min, max int, lazy bool, follow *[256]bool) bool {
+	var first [256]bool
+	if firstBytes(n, &first) {
+		return false
+	}
+	f := *follow
+	for b, ok := range first {
+		f[b] = f[b] || ok
+	}
+	if !determined(n, &f) {
+		return false
+	}
+	if min == max {
+		return true
+	}
+	if lazy {
+		// The preferred match takes as few iterations as possible.
+		return false
+	}
+	for b, ok := range first {
+		if ok && follow[b] {
+			return false
+		}
+	}
+	return true
+}
+
+// delegate runs the delegate of i at pos and returns the end of the match.
+// ok is false if the delegate can not be used at pos.
+func (m *machine) delegate(i *inst, pos int) (end int, matched, ok bool) {
+	d := i.delegate
+	if d.root && m.longest {
+		return 0, false, false
+	}
+	if !d.nullable && pos == len(m.b) {
+		m.ended()
+		return 0, false, true
+	}
+	if !d.nullable && !d.first[m.b[pos]] {
+		return 0, false, true
+	}
+	re, start := d.re, pos
+	if d.after != nil && pos > 0 {
+		_, size := utf8.DecodeLastRune(m.b[:pos])
+		if _, s := utf8.DecodeRune(m.b[pos-size:]); s != size {
+			return 0, false, false
+		}
+		re, start = d.after, pos-size
+	}
+	if m.nocap {
+		loc := m.runDelegate(re, start, false)
+		if loc == nil {
+			return 0, false, true
+		}
+		return start + loc[1], true, true
+	}
+	loc := m.runDelegate(re, start, true)
+	if loc == nil {
+		return 0, false, true
+	}
+	for k, index := range d.caps {
+		if loc[k*2+2] >= 0 {
+			m.set(index*2, start+loc[k*2+2])
+			m.set(index*2+1, start+loc[k*2+3])
+		}
+	}
+	return start + loc[1], true, true
+}
+
+// runDelegate matches re against the text from start. If the text is
+// partial, it is read as a stream to find out whether the built-in
+// engine looked at its end.
+func (m *machine) runDelegate(re *stdregexp.Regexp, start int, submatch bool) []int {
+	if !m.partial {
+		if submatch {
+			return re.FindSubmatchIndex(m.b[start:])
+		}
+		return re.FindIndex(m.b[start:])
+	}
+	r := &endReader{b: m.b[start:]}
+	var loc []int
+	if submatch {
+		loc = re.FindReaderSubmatchIndex(r)
+	} else {
+		loc = re.FindReaderIndex(r)
+	}
+	if r.ended {
+		m.ended()
+	}
+	return loc
+}
+
+// endReader is a RuneReader of b that records whether it was read to the end.
+type endReader struct {
+	b     []byte
+	pos   int
+	ended bool
+}
+
+func (r *endReader) ReadRune() (rune, int, error) {
+	if r.pos == len(r.b) {
+		r.ended = true
+		return 0, 0, io.EOF
+	}
+	c, size := utf8.DecodeRune(r.b[r.pos:])
+	r.pos += size
+	return c, size, nil
+}
+
+// backtracks reports whether n contains an alternation or a loop over
+// more than a single rune. Other regular subtrees are matched by the
+// backtracker without much backtracking.
+func backtracks(n node) bool {
+	switch e := n.(type) {
+	case groupNode:
+		for _, c := range e.N {
+			if backtracks(c) {
+				return true
+			}
+		}
+	case alterNode:
+		return len(e.N) > 1
+	case repeatNode:
+		if _, ok := e.N.(runeMatcher); ok {
+			return false
+		}
+		return e.Max != 1 || backtracks(e.N)
+	}
+	return false
+}
+
+// firstBytes adds the bytes a match of n can start with to set.
+// It reports whether n can match the empty string, in which case
+// the match can start with any byte.
+func firstBytes(n node, set *[256]bool) bool {
+	switch e := n.(type) {
+	case nil:
+		return true
+	case groupNode:
+		for _, c := range e.N {
+			if !firstBytes(c, set) {
+				return false
+			}
+		}
+		return true
+	case alterNode:
+		nullable := false
+		for _, c := range e.N {
+			if firstBytes(c, set) {
+				nullable = true
+			}
+		}
+		return nullable
+	case repeatNode:
+		return firstBytes(e.N, set) || e.Min == 0
+	case anyCharRepeatNode:
+		return firstBytes(anyCharNode{Flags: e.Flags}, set) || e.Min == 0
+	case anyCharNode:
+		for b := range set {
+			set[b] = set[b] || b != '\n' || e.Flags&syntax.DotNL != 0
+		}
+		return false
+	case charNode:
+		var r []rune
+		for _, m := range e.Matcher {
+			r = append(r, matcherRanges(m)...)
+		}
+		r = normalizeRanges(r)
+		if e.Reversed {
+			r = negateRanges(r)
+		}
+		for i := 0; i+1 < len(r); i += 2 {
+			for b := leadByte(r[i]); b <= leadByte(r[i+1]); b++ {
+				set[b] = true
+			}
+			if r[i] <= utf8.RuneError && utf8.RuneError <= r[i+1] {
+				// Invalid UTF-8 is decoded as RuneError.
+				for b := utf8.RuneSelf; b < len(set); b++ {
+					set[b] = true
+				}
+			}
+		}
+		return false
+	case literalNode:
+		if len(e.L) == 0 {
+			return true
+		}
+		set[e.L[0]] = true
+		if e.Flags&syntax.FoldCase != 0 {
+			r, _ := utf8.DecodeRune(e.L)
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				set[leadByte(f)] = true
+			}
+		}
+		return false
+	case backRefNode, funcNode:
+		// The text they match is only known when matching.
+		for b := range set {
+			set[b] = true
+		}
+		return false
+	}
+	return true
+}
+
+// leadByte returns the first byte of the encoding of r. It grows with r,
+// so the lead bytes of a range of runes lie between those of its bounds.
+func leadByte(r rune) int {
+	if 0xD800 <= r && r <= 0xDFFF {
+		// Surrogates are not encoded, they lie between 0xED and 0xEE.
+		return 0xED
+	}
+	var b [utf8.UTFMax]byte
+	utf8.EncodeRune(b[:], r)
+	return int(b[0])
+}
+
+// needsContext reports whether n contains an assertion that looks at
+// the text preceding the position where it is evaluated.
+func needsContext(n node) bool {
+	switch e := n.(type) {
+	case groupNode:
+		for _, c := range e.N {
+			if needsContext(c) {
+				return true
+			}
+		}
+	case alterNode:
+		for _, c := range e.N {
+			if c != nil && needsContext(c) {
+				return true
+			}
+		}
+	case repeatNode:
+		return needsContext(e.N)
+	case beginNode, wordBoundaryNode:
+		return true
+	}
+	return false
+}
+
+// toSyntax converts a regular subtree to the syntax of Go's built-in engine.
+// The indices of its captures are appended to caps in order.
+// ok is cleared if the subtree can not be converted.
+func toSyntax(n node, caps *[]int, ok *bool) *syntax.Regexp {
+	switch e := n.(type) {
+	case nil:
+		return &syntax.Regexp{Op: syntax.OpEmptyMatch}
+	case groupNode:
+		index := 0
+		if e.Index > 0 {
+			*caps = append(*caps, e.Index)
+			index = len(*caps)
+		}
+		re := &syntax.Regexp{Op: syntax.OpConcat}
+		for _, c := range e.N {
+			re.Sub = append(re.Sub, toSyntax(c, caps, ok))
+		}
+		if len(re.Sub) == 0 {
+			re.Op = syntax.OpEmptyMatch
+		}
+		if index > 0 {
+			re = &syntax.Regexp{Op: syntax.OpCapture, Cap: index, Sub: []*syntax.Regexp{re}}
+		}
+		return re
+	case alterNode:
+		re := &syntax.Regexp{Op: syntax.OpAlternate}
+		for _, c := range e.N {
+			re.Sub = append(re.Sub, toSyntax(c, caps, ok))
+		}
+		return re
+	case repeatNode:
+		return repeatSyntax(toSyntax(e.N, caps, ok), e.Min, e.Max, e.Reluctant)
+	case anyCharRepeatNode:
+		return repeatSyntax(toSyntax(anyCharNode{Flags: e.Flags}, caps, ok), e.Min, e.Max, e.Reluctant)
+	case anyCharNode:
+		if e.Flags&syntax.DotNL != 0 {
+			return &syntax.Regexp{Op: syntax.OpAnyChar}
+		}
+		return &syntax.Regexp{Op: syntax.OpAnyCharNotNL}
+	case charNode:
+		var r []rune
+		for _, m := range e.Matcher {
+			r = append(r, matcherRanges(m)...)
+		}
+		r = normalizeRanges(r)
+		if e.Reversed {
+			r = negateRanges(r)
+		}
+		if len(r) == 0 {
+			return &syntax.Regexp{Op: syntax.OpNoMatch}
+		}
+		return &syntax.Regexp{Op: syntax.OpCharClass, Rune: r}
+	case literalNode:
+		re := &syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune(string(e.L))}
+		if !utf8.Valid(e.L) {
+			*ok = false
+		}
+		if e.Flags&syntax.FoldCase != 0 {
+			re.Flags = syntax.FoldCase
+		}
+		return re
+	case beginNode:
+		if e.Line && e.Flags&syntax.OneLine == 0 {
+			return &syntax.Regexp{Op: syntax.OpBeginLine}
+		}
+		return &syntax.Regexp{Op: syntax.OpBeginText}
+	case endNode:
+		if e.Line && e.Flags&syntax.OneLine == 0 {
+			return &syntax.Regexp{Op: syntax.OpEndLine}
+		}
+		return &syntax.Regexp{Op: syntax.OpEndText}
+	case wordBoundaryNode:
+		if e.Reversed {
+			return &syntax.Regexp{Op: syntax.OpNoWordBoundary}
+		}
+		return &syntax.Regexp{Op: syntax.OpWordBoundary}
+	}
+	*ok = false
+	return &syntax.Regexp{Op: syntax.OpNoMatch}
+}
+
+func repeatSyntax(sub *syntax.Regexp, min, max int, lazy bool) *syntax.Regexp {
+	re := &syntax.Regexp{Op: syntax.OpRepeat, Min: min, Max: max, Sub: []*syntax.Regexp{sub}}
+	switch {
+	case min == 0 && max < 0:
+		re.Op = syntax.OpStar
+	case min == 1 && max < 0:
+		re.Op = syntax.OpPlus
+	case min == 0 && max == 1:
+		re.Op = syntax.OpQuest
+	}
+	if lazy {
+		re.Flags |= syntax.NonGreedy
+	}
+	return re
+}
+
+// matcherRanges returns the sorted rune ranges matched by m.
+func matcherRanges(m charNodeMatcher) []rune {
+	switch e := m.(type) {
+	case rangeMatcher:
+		return []rune{e.B, e.E}
+	case mapMatcher:
+		var r []rune
+		for c := range e.M {
+			r = append(r, c, c)
+		}
+		return normalizeRanges(r)
+	case unicodeMatcher:
+		return tableRanges(e.R)
+	case *unicodeMatcher:
+		return tableRanges(e.R)
+	case reverseMatcher:
+		return negateRanges(matcherRanges(e.M))
+	case *reverseMatcher:
+		return negateRanges(matcherRanges(e.M))
+	}
+	// The remaining matchers only match ASCII.
+	var r []rune
+	for c := rune(0); c < utf8.RuneSelf; c++ {
+		if m.Match(c, 0) {
+			r = append(r, c, c)
+		}
+	}
+	return normalizeRanges(r)
+}
+
+func tableRanges(t *unicode.RangeTable) []rune {
+	var r []rune
+	for _, g := range t.R16 {
+		for c := rune(g.Lo); c <= rune(g.Hi); c += rune(g.Stride) {
+			if g.Stride == 1 {
+				r = append(r, c, rune(g.Hi))
+				break
+			}
+			r = append(r, c, c)
+		}
+	}
+	for _, g := range t.R32 {
+		for c := rune(g.Lo); c <= rune(g.Hi); c += rune(g.Stride) {
+			if g.Stride == 1 {
+				r = append(r, c, rune(g.Hi))
+				break
+			}
+			r = append(r, c, c)
+		}
+	}
+	return normalizeRanges(r)
+}
+
+// normalizeRanges sorts rune ranges and merges those that overlap or touch.
+func normalizeRanges(r []rune) []rune {
+	type rng struct{ lo, hi rune }
+	rs := make([]rng, 0, len(r)/2)
+	for i := 0; i+1 < len(r); i += 2 {
+		rs = append(rs, rng{r[i], r[i+1]})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].lo < rs[j].lo })
+	out := r[:0:0]
+	for _, g := range rs {
+		if n := len(out); n > 0 && g.lo <= out[n-1]+1 {
+			if g.hi > out[n-1] {
+				out[n-1] = g.hi
+			}
+			continue
+		}
+		out = append(out, g.lo, g.hi)
+	}
+	return out
+}
+
+// negateRanges returns the complement of sorted rune ranges.
+func negateRanges(r []rune) []rune {
+	var out []rune
+	next := rune(0)
+	for i := 0; i+1 < len(r); i += 2 {
+		if r[i] > next {
+			out = append(out, next, r[i]-1)
+		}
+		next = r[i+1] + 1
+	}
+	if next <= unicode.MaxRune {
+		out = append(out, next, unicode.MaxRune)
+	}
+	return out
+}
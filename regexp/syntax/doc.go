@@ -30,6 +30,9 @@ Back reference:
   \k{N}          refer to numbered capturing
   \k{Name}       refer to named capturing
 
+The referenced group must exist, but can follow the reference. As in Perl,
+a reference to a group that has not participated in the match fails.
+
 
 Lookbehind limitations
 
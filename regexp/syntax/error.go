@@ -1,26 +1,177 @@
 package syntax
 
 import (
+	stdregexp "regexp"
 	"regexp/syntax"
+	"strings"
 	"unicode/utf8"
 )
 
-func newErrorBytes(code syntax.ErrorCode, bytes []byte) syntax.Error {
-	return syntax.Error{
-		Code: code,
-		Expr: string(bytes),
+// Error codes of the failures that are specific to the extended syntax.
+// The other failures are reported with the codes of regexp/syntax.
+const (
+	ErrUnboundedLookbehind syntax.ErrorCode = "lookbehind of unbounded length"
+	ErrInvalidFunctionCall syntax.ErrorCode = "invalid function call"
+	ErrInvalidBackref      syntax.ErrorCode = "invalid back reference"
+	ErrUndefinedBackref    syntax.ErrorCode = "back reference to an undefined group"
+)
+
+// Error describes a failure to parse a regular expression and gives the
+// offending text.
+type Error struct {
+	Code    syntax.ErrorCode
+	Expr    string // the offending part of Pattern
+	Pattern string // the expression being parsed
+
+	// Offset and RuneOffset are the offsets of Expr in Pattern,
+	// in bytes and in runes.
+	Offset     int
+	RuneOffset int
+}
+
+func (e *Error) Error() string {
+	return "error parsing regexp: " + e.Code.String() + ": `" + e.Expr + "`"
+}
+
+// Unwrap returns the equivalent regexp/syntax error, or nil if the code
+// is specific to the extended syntax.
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case ErrUnboundedLookbehind, ErrInvalidFunctionCall, ErrInvalidBackref, ErrUndefinedBackref,
+		WarnEmptyAlternative, WarnNestedQuantifier:
+		return nil
+	}
+	return &syntax.Error{Code: e.Code, Expr: e.Expr}
+}
+
+// Caret returns the line of the pattern holding the offending text, and
+// below it a line that marks that text with a caret and tildes, with one
+// column per rune:
+//
+//	a(b|c
+//	 ^~~~
+func (e *Error) Caret() string {
+	start := strings.LastIndexByte(e.Pattern[:e.Offset], '\n') + 1
+	end := len(e.Pattern)
+	if i := strings.IndexByte(e.Pattern[e.Offset:], '\n'); i >= 0 {
+		end = e.Offset + i
+	}
+	var b strings.Builder
+	b.WriteString(e.Pattern[start:end])
+	b.WriteByte('\n')
+	// Tabs are kept so that the marks line up with the text.
+	for _, r := range e.Pattern[start:e.Offset] {
+		if r == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteByte('^')
+	n := min(utf8.RuneCountInString(e.Expr), utf8.RuneCountInString(e.Pattern[e.Offset:end]))
+	b.WriteString(strings.Repeat("~", max(n-1, 0)))
+	return b.String()
+}
+
+// commentRegexp matches the comments that the regexp package removes from a
+// pattern without extended syntax before compiling it with the built-in
+// engine.
+var commentRegexp = stdregexp.MustCompile(`(^|[^\\]|\\\\)((?:\(\?#[^)]*\))+)`)
+
+// builtinError returns the error of the built-in parser for pattern, or nil.
+// The built-in parser does not tell where the offending text is, so it is
+// taken as the first occurrence of that text that ends a prefix of the
+// pattern with the same error.
+func builtinError(pattern string) *Error {
+	parse := func(s string) *syntax.Error {
+		_, err := syntax.Parse(commentRegexp.ReplaceAllString(s, "$1"), syntax.Perl)
+		e, _ := err.(*syntax.Error)
+		return e
+	}
+	e := parse(pattern)
+	if e == nil {
+		return nil
+	}
+	offset := 0
+	for i := 0; i+len(e.Expr) <= len(pattern); i++ {
+		if !strings.HasPrefix(pattern[i:], e.Expr) {
+			continue
+		}
+		if pe := parse(pattern[:i+len(e.Expr)]); pe != nil && *pe == *e {
+			offset = i
+			break
+		}
+	}
+	return &Error{
+		Code:       e.Code,
+		Expr:       e.Expr,
+		Pattern:    pattern,
+		Offset:     offset,
+		RuneOffset: utf8.RuneCountInString(pattern[:offset]),
+	}
+}
+
+// error returns the error for the runes of the pattern from start to end.
+// The bounds are clamped to the pattern.
+func (p *parser) error(code syntax.ErrorCode, start, end int) *Error {
+	start, end = max(start, 0), min(end, len(p.runes))
+	offset := 0
+	for _, r := range p.runes[:start] {
+		offset += utf8.RuneLen(r)
+	}
+	return &Error{
+		Code:       code,
+		Expr:       string(p.runes[start:end]),
+		Pattern:    p.pattern,
+		Offset:     offset,
+		RuneOffset: start,
 	}
 }
 
-func newErrorRunes(code syntax.ErrorCode, runes []rune) syntax.Error {
-	var rbytes []byte
-	for _, r := range runes {
-		var lit [utf8.UTFMax]byte
-		l := utf8.EncodeRune(lit[:], r)
-		rbytes = append(rbytes, lit[:l]...)
+// report panics with the error for the runes of the pattern from start to
+// end. In check mode it records the error and returns instead, for the
+// parsing to go on as if the text was not there.
+func (p *parser) report(code syntax.ErrorCode, start, end int) {
+	e := p.error(code, start, end)
+	if !p.check {
+		panic(e)
 	}
-	return syntax.Error{
-		Code: code,
-		Expr: string(rbytes),
+	p.diags = append(p.diags, Diagnostic{Severity: SeverityError, Error: e})
+}
+
+// fail is like report but never returns. In check mode the parsing goes
+// on after the error, from the innermost group being parsed.
+func (p *parser) fail(code syntax.ErrorCode, start, end int) {
+	p.report(code, start, end)
+	panic(recovery(min(end, len(p.runes))))
+}
+
+// warn records a warning for the runes from start to end, if they are
+// wanted.
+func (p *parser) warn(code syntax.ErrorCode, start, end int) {
+	if p.warnings {
+		p.diags = append(p.diags, Diagnostic{Severity: SeverityWarning, Error: p.error(code, start, end)})
 	}
 }
+
+// pos returns the offset of s in the pattern. Every rune slice handled by
+// the parser is a part of p.runes, which shares its end of capacity.
+func (p *parser) pos(s []rune) int {
+	return cap(p.runes) - cap(s)
+}
+
+// failGroup panics with the error for the group whose body is runes.
+func (p *parser) failGroup(code syntax.ErrorCode, runes []rune) {
+	p.fail(code, p.pos(runes)-1, p.pos(runes)+len(runes)+1)
+}
+
+// reportGroup reports the error for the group whose body is runes.
+func (p *parser) reportGroup(code syntax.ErrorCode, runes []rune) {
+	p.report(code, p.pos(runes)-1, p.pos(runes)+len(runes)+1)
+}
+
+// failEscape panics with the error for the escape sequence whose first n
+// runes after the backslash are at runes.
+func (p *parser) failEscape(runes []rune, n int) {
+	p.fail(syntax.ErrInvalidEscape, p.pos(runes)-1, p.pos(runes)+n)
+}
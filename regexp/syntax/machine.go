@@ -0,0 +1,647 @@
+package syntax
+
+import (
+	"bytes"
+	"context"
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// checkInterval is the number of steps between two context checks.
+const checkInterval = 256
+
+// state is shared by all runs of a single search and carries the
+// context used to abandon matching.
+type state struct {
+	ctx   context.Context
+	steps int
+	err   error
+}
+
+// aborted reports whether matching should stop. The context is
+// consulted on the first call and then every checkInterval steps.
+func (s *state) aborted() bool {
+	if s == nil || s.ctx == nil {
+		return false
+	}
+	if s.err != nil {
+		return true
+	}
+	if s.steps%checkInterval == 0 {
+		s.err = s.ctx.Err()
+	}
+	s.steps++
+	return s.err != nil
+}
+
+const (
+	frameAlt    = iota // resume at pc
+	frameGreedy        // give back one rune of the repetition at pc
+	frameLazy          // take one more rune for the repetition at pc
+)
+
+// frame is a backtracking point. undo is the length of the undo log
+// when the frame was pushed.
+type frame struct {
+	kind int
+	pc   int
+	pos  int
+	n    int
+	undo int
+}
+
+// change is an entry of the undo log: the previous value of a slot.
+type change struct {
+	slot int
+	old  int
+}
+
+// machine executes a program against an input with a backtracking stack.
+type machine struct {
+	p     *prog
+	b     []byte
+	calls []func(ctx Context) interface{}
+	st    *state
+
+	// longest is set while matching the longest match.
+	longest bool
+
+	// nocap is set if captures are neither reported nor referenced.
+	nocap bool
+
+	// partial is set if the text continues after b, and hitEnd is set
+	// once matching depended on where b ends.
+	partial bool
+	hitEnd  bool
+
+	// caps is the slot array. Every change to it is recorded in undo,
+	// so that backtracking can restore the slots of a frame.
+	caps []int
+	undo []change
+
+	// noLead is set if the last attempt failed because the subtree the
+	// lead of the program finds did not match.
+	noLead bool
+
+	// best holds the slots of the longest match found so far.
+	best []int
+
+	stack []frame
+
+	// steps counts the instructions executed by the current attempt.
+	steps int
+	memo  memoTable
+	stamp uint32
+
+	// spare is an emptied memo table kept from an earlier search.
+	spare memoTable
+
+	// local is the state of searches without a context.
+	local state
+}
+
+func newMachine(p *prog) *machine {
+	return &machine{
+		p:     p,
+		stamp: 1,
+	}
+}
+
+// reset prepares m for a search of b. Only the space allocated by
+// earlier searches is kept.
+func (m *machine) reset(b []byte, calls []func(ctx Context) interface{}, st *state) {
+	if st == nil {
+		m.local = state{}
+		st = &m.local
+	}
+	m.b, m.calls, m.st = b, calls, st
+	m.partial, m.hitEnd = false, false
+	if m.memo != nil {
+		// Large tables are dropped rather than kept alive in a pool.
+		m.spare = nil
+		if len(m.memo) <= memoKeep {
+			clear(m.memo)
+			m.spare = m.memo
+		}
+		m.memo = nil
+	}
+}
+
+// release drops the references of m to the text of its last search.
+func (m *machine) release() {
+	m.b, m.calls, m.st = nil, nil, nil
+}
+
+// match runs the program anchored at pos and returns the end of the
+// first match, or of the longest one if longest is set. The slots of
+// the match are left in m.caps. stamp identifies the memo entries of
+// the search: the attempts of a search share them, as all but the last
+// one fail.
+func (m *machine) match(pos int, longest bool, stamp uint32) (int, bool) {
+	if m.caps == nil {
+		m.caps = make([]int, m.p.nslot)
+	}
+	for i := range m.caps {
+		m.caps[i] = -1
+	}
+	m.undo = m.undo[:0]
+	m.stack = m.stack[:0]
+	m.steps = 0
+	m.longest = longest
+	m.noLead = false
+	return m.run(0, pos, -1, longest, stamp)
+}
+
+// appendLoc appends the location of the match from start to end to dst,
+// followed by the bounds of its captures if submatch is set.
+func (m *machine) appendLoc(dst []int, start, end int, submatch bool) []int {
+	dst = append(dst, start, end)
+	if submatch && m.p.ncap > 1 {
+		dst = append(dst, m.caps[2:m.p.ncap*2]...)
+	}
+	return dst
+}
+
+func (m *machine) set(slot, v int) {
+	m.undo = append(m.undo, change{slot: slot, old: m.caps[slot]})
+	m.caps[slot] = v
+}
+
+// rollback restores the slots as they were when the undo log had n entries.
+func (m *machine) rollback(n int) {
+	for k := len(m.undo) - 1; k >= n; k-- {
+		m.caps[m.undo[k].slot] = m.undo[k].old
+	}
+	m.undo = m.undo[:n]
+}
+
+func (m *machine) push(f frame) {
+	f.undo = len(m.undo)
+	m.stack = append(m.stack, f)
+}
+
+// run executes the program from pc at pos until it reaches a match
+// instruction, which has to be at end unless end is negative.
+// It returns the position of the match and leaves its slots in m.caps.
+//
+// Frames pushed by run are removed before it returns, so run can be
+// called recursively for sub-programs. stamp identifies the memo
+// entries that belong to this run.
+func (m *machine) run(pc, pos, end int, longest bool, stamp uint32) (int, bool) {
+	base := len(m.stack)
+	best := -1
+
+	for {
+		ok := m.step(&pc, &pos, end, stamp)
+		if m.st.err != nil {
+			m.stack = m.stack[:base]
+			return -1, false
+		}
+		if ok {
+			i := &m.p.inst[pc]
+			if i.op == opMatch {
+				if !longest {
+					m.stack = m.stack[:base]
+					return pos, true
+				}
+				if pos > best {
+					best = pos
+					m.best = append(m.best[:0], m.caps...)
+				}
+			} else {
+				continue
+			}
+		}
+		if !m.backtrack(base, &pc, &pos) {
+			break
+		}
+	}
+	if best >= 0 {
+		for slot, v := range m.best {
+			if m.caps[slot] != v {
+				m.set(slot, v)
+			}
+		}
+		return best, true
+	}
+	return -1, false
+}
+
+// step executes instructions from *pc until a match instruction is reached
+// or the current path fails. It reports false on failure.
+func (m *machine) step(pc, pos *int, end int, stamp uint32) bool {
+	for {
+		if m.st.aborted() {
+			return false
+		}
+		m.steps++
+		i := &m.p.inst[*pc]
+		if i.memo && !m.visit(i, *pc, *pos, stamp) {
+			return false
+		}
+		switch i.op {
+		case opMatch:
+			return end < 0 || *pos == end
+
+		case opSplit:
+			m.push(frame{kind: frameAlt, pc: i.y, pos: *pos})
+			*pc = i.x
+
+		case opJmp:
+			*pc = i.x
+
+		case opLiteral:
+			b := m.b[*pos:]
+			l := len(i.lit)
+			if i.flags&syntax.FoldCase != 0 {
+				var ok, short bool
+				if l, ok, short = foldPrefix(i.lit, b); !ok {
+					if short {
+						m.ended()
+					}
+					return false
+				}
+			} else if l > len(b) {
+				if bytes.HasPrefix(i.lit, b) {
+					m.ended()
+				}
+				return false
+			} else if !bytes.Equal(i.lit, b[:l]) {
+				return false
+			}
+			*pos += l
+			*pc++
+
+		case opChar:
+			r, size := utf8.DecodeRune(m.b[*pos:])
+			if size == 0 {
+				m.ended()
+				return false
+			}
+			if !i.matcher.matchRune(r) {
+				return false
+			}
+			*pos += size
+			*pc++
+
+		case opRepeatRune:
+			if !m.repeatRune(i, *pc, pos) {
+				return false
+			}
+			*pc++
+
+		case opBegin:
+			if !m.isBegin(i, *pos) {
+				return false
+			}
+			*pc++
+
+		case opEnd:
+			if !m.isEnd(i, *pos) {
+				return false
+			}
+			*pc++
+
+		case opWordBoundary:
+			if m.isWordBoundary(*pos) == i.negative {
+				return false
+			}
+			*pc++
+
+		case opBackRef:
+			l, ok := m.backRef(i, *pos)
+			if !ok {
+				return false
+			}
+			*pos += l
+			*pc++
+
+		case opGroupStart:
+			if !m.nocap {
+				m.set(m.p.pending(i.arg), *pos)
+			}
+			*pc++
+
+		case opGroupEnd:
+			if !m.nocap {
+				m.set(i.arg*2, m.caps[m.p.pending(i.arg)])
+				m.set(i.arg*2+1, *pos)
+			}
+			*pc++
+
+		case opLoopInit:
+			m.set(i.arg, firstIteration(*pos))
+			*pc++
+
+		case opLoopMark:
+			if m.caps[i.arg] == firstIteration(*pos) {
+				return false
+			}
+			m.set(i.arg, *pos)
+			*pc++
+
+		case opLoopCheck:
+			if m.caps[i.arg] == *pos {
+				return false
+			}
+			*pc++
+
+		case opCountInit:
+			m.set(i.arg, 0)
+			*pc++
+
+		case opCount:
+			n := m.caps[i.arg]
+			switch {
+			case n < i.min:
+				*pc++
+			case n >= i.max:
+				*pc = i.x
+			case i.lazy:
+				m.push(frame{kind: frameAlt, pc: *pc + 1, pos: *pos})
+				*pc = i.x
+			default:
+				m.push(frame{kind: frameAlt, pc: i.x, pos: *pos})
+				*pc++
+			}
+
+		case opCountNext:
+			m.set(i.arg, m.caps[i.arg]+1)
+			*pc = i.x
+
+		case opAtomic:
+			e, ok := m.run(*pc+1, *pos, -1, false, m.next())
+			if !ok {
+				m.noLead = *pc == 0 && m.p.lead != nil
+				return false
+			}
+			*pos = e
+			*pc = i.x
+
+		case opLookahead:
+			undo := len(m.undo)
+			_, ok := m.run(*pc+1, *pos, -1, false, m.next())
+			m.rollback(undo)
+			if ok == i.negative {
+				return false
+			}
+			*pc = i.x
+
+		case opLookbehind:
+			if m.lookbehind(i, *pc, *pos) == i.negative {
+				return false
+			}
+			*pc = i.x
+
+		case opCall:
+			l, ok := m.call(i, *pos)
+			if !ok {
+				return false
+			}
+			*pos += l
+			*pc++
+
+		case opDelegate:
+			e, matched, ok := m.delegate(i, *pos)
+			if !ok {
+				*pc++
+				break
+			}
+			if !matched {
+				m.noLead = *pc == 0 && m.p.lead != nil
+				return false
+			}
+			*pos = e
+			*pc = i.x
+		}
+	}
+}
+
+// backtrack resumes the most recent frame above base.
+func (m *machine) backtrack(base int, pc, pos *int) bool {
+	for len(m.stack) > base {
+		top := len(m.stack) - 1
+		f := &m.stack[top]
+		i := &m.p.inst[f.pc]
+		m.rollback(f.undo)
+		switch f.kind {
+		case frameAlt:
+			*pc, *pos = f.pc, f.pos
+			m.stack = m.stack[:top]
+			return true
+		case frameGreedy:
+			_, size := utf8.DecodeLastRune(m.b[:f.pos])
+			f.pos -= size
+			f.n--
+			*pc, *pos = f.pc+1, f.pos
+			if f.n <= i.min {
+				m.stack = m.stack[:top]
+			}
+			return true
+		case frameLazy:
+			r, size := utf8.DecodeRune(m.b[f.pos:])
+			if size == 0 {
+				m.ended()
+			}
+			if size == 0 || !i.matcher.matchRune(r) {
+				m.stack = m.stack[:top]
+				continue
+			}
+			f.pos += size
+			f.n++
+			*pc, *pos = f.pc+1, f.pos
+			if i.max >= 0 && f.n >= i.max {
+				m.stack = m.stack[:top]
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// repeatRune matches the repetition of a single rune at *pos.
+func (m *machine) repeatRune(i *inst, pc int, pos *int) bool {
+	n := 0
+	p := *pos
+	limit := i.max
+	if i.lazy {
+		limit = i.min
+	}
+	for limit < 0 || n < limit {
+		r, size := utf8.DecodeRune(m.b[p:])
+		if size == 0 {
+			m.ended()
+		}
+		if size == 0 || !i.matcher.matchRune(r) {
+			break
+		}
+		p += size
+		n++
+	}
+	if n < i.min {
+		return false
+	}
+	if !i.possessive {
+		if i.lazy {
+			if i.max < 0 || n < i.max {
+				m.push(frame{kind: frameLazy, pc: pc, pos: p, n: n})
+			}
+		} else if n > i.min {
+			m.push(frame{kind: frameGreedy, pc: pc, pos: p, n: n})
+		}
+	}
+	*pos = p
+	return true
+}
+
+// foldPrefix reports whether b starts with lit under Unicode case folding
+// and returns the length of the matching text. short reports that b is
+// a prefix of a match of lit.
+func foldPrefix(lit, b []byte) (n int, ok, short bool) {
+	for len(lit) > 0 {
+		r, size := utf8.DecodeRune(lit)
+		lit = lit[size:]
+		s, l := utf8.DecodeRune(b[n:])
+		if l == 0 {
+			return 0, false, true
+		}
+		if !equalFold(r, s) {
+			return 0, false, false
+		}
+		n += l
+	}
+	return n, true, false
+}
+
+// ended records that matching read to the end of m.b, which is not the
+// end of the text if it is partial.
+func (m *machine) ended() {
+	if m.partial {
+		m.hitEnd = true
+	}
+}
+
+// equalFold reports whether r and s are equal under simple case folding.
+func equalFold(r, s rune) bool {
+	if r == s {
+		return true
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *machine) isBegin(i *inst, pos int) bool {
+	if pos == 0 {
+		return true
+	}
+	return i.line && i.flags&syntax.OneLine == 0 && m.b[pos-1] == '\n'
+}
+
+func (m *machine) isEnd(i *inst, pos int) bool {
+	if pos == len(m.b) {
+		m.ended()
+		return true
+	}
+	return i.line && i.flags&syntax.OneLine == 0 && m.b[pos] == '\n'
+}
+
+func (m *machine) isWordBoundary(pos int) bool {
+	match := false
+	if pos < len(m.b) {
+		if pos > 0 && isASCIIWord(rune(m.b[pos])) != isASCIIWord(rune(m.b[pos-1])) {
+			match = true
+		}
+		if pos == 0 && isASCIIWord(rune(m.b[pos])) {
+			match = true
+		}
+	}
+	if pos == len(m.b) {
+		m.ended()
+	}
+	if len(m.b) > 0 && pos == len(m.b) {
+		r, _ := utf8.DecodeLastRune(m.b)
+		if isASCIIWord(r) {
+			match = true
+		}
+	}
+	return match
+}
+
+// backRef returns the length of the captured text found at pos.
+// As in Perl, a reference to a group that has not participated in the
+// match so far fails, including a forward reference on the first pass.
+func (m *machine) backRef(i *inst, pos int) (int, bool) {
+	index := i.arg
+	if m.caps[index*2] < 0 {
+		return 0, false
+	}
+	b := m.b[m.caps[index*2]:m.caps[index*2+1]]
+	rest := m.b[pos:]
+	l := len(b)
+	if l > len(rest) {
+		l = len(rest)
+		m.ended()
+	}
+	if i.flags&syntax.FoldCase != 0 && bytes.EqualFold(b, rest[:l]) {
+		return l, true
+	}
+	return l, bytes.Equal(b, rest[:l])
+}
+
+// lookbehind reports whether the sub-program following pc matches
+// a text ending at pos.
+func (m *machine) lookbehind(i *inst, pc, pos int) bool {
+	undo := len(m.undo)
+	defer m.rollback(undo)
+	for l := i.min; l <= i.max && l <= pos; l++ {
+		if pos-l < len(m.b) && !utf8.RuneStart(m.b[pos-l]) {
+			continue
+		}
+		_, ok := m.run(pc+1, pos-l, pos, false, m.next())
+		m.rollback(undo)
+		if ok {
+			return true
+		}
+		if m.st.err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// call runs an inline function and returns the length it consumed.
+func (m *machine) call(i *inst, pos int) (int, bool) {
+	if i.arg >= len(m.calls) || m.calls[i.arg] == nil {
+		return 0, false
+	}
+	matches := make(map[interface{}][]int)
+	for k := 1; k < m.p.ncap; k++ {
+		if m.caps[k*2] < 0 {
+			continue
+		}
+		loc := []int{m.caps[k*2], m.caps[k*2+1]}
+		matches[k] = loc
+		if name := m.p.subexpNames[k]; len(name) > 0 {
+			matches[name] = loc
+		}
+	}
+	res := m.calls[i.arg](Context{
+		Data:    m.b,
+		Cursor:  pos,
+		Matches: matches,
+	})
+	switch v := res.(type) {
+	case nil:
+		return 0, true
+	case int:
+		if v >= 0 && pos+v <= len(m.b) {
+			return v, true
+		}
+	}
+	return 0, false
+}
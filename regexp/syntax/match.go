@@ -0,0 +1,255 @@
+package syntax
+
+import "iter"
+
+// Match is a match of a regular expression, with the matches of its
+// subexpressions. Groups are numbered as in SubexpNames, group 0 being
+// the whole match. A group that did not participate in the match is
+// reported as unmatched rather than as an empty string.
+//
+// A Match holds a copy of the text it refers to, so it remains valid
+// when the searched text is modified.
+type Match struct {
+	// text is the matched text, which starts at offset lo of the searched
+	// text, and loc holds the group bounds in the searched text. The
+	// matches given to replacement functions hold the whole text instead.
+	text  string
+	lo    int
+	loc   []int
+	index int
+	re    *regexp
+}
+
+// newMatch returns the match of re at loc in b, as returned by
+// FindSubmatchIndex.
+func (re *regexp) newMatch(b []byte, loc []int) *Match {
+	return &Match{text: string(b[loc[0]:loc[1]]), lo: loc[0], loc: loc, re: re}
+}
+
+// newStringMatch is like newMatch but the searched text is a string.
+func (re *regexp) newStringMatch(s string, loc []int) *Match {
+	return &Match{text: s[loc[0]:loc[1]], lo: loc[0], loc: loc, re: re}
+}
+
+// newMatches returns the matches of re at locs in b, as returned by
+// FindAllSubmatchIndex, numbered in order.
+func (re *regexp) newMatches(b []byte, locs [][]int) []*Match {
+	var ret []*Match
+	for k, loc := range locs {
+		m := re.newMatch(b, loc)
+		m.index = k
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// newStringMatches is like newMatches but the searched text is a string.
+func (re *regexp) newStringMatches(s string, locs [][]int) []*Match {
+	var ret []*Match
+	for k, loc := range locs {
+		m := re.newStringMatch(s, loc)
+		m.index = k
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// replaceMatches returns a copy of src in which the matches yielded by
+// matches, with their numbers and index pairs as returned by all, have
+// been replaced by the return value of repl. The Match given to repl
+// holds the whole of src. Replacement stops at the first error of repl,
+// which is returned.
+func (re *regexp) replaceMatches(src string, matches iter.Seq2[int, []int], repl func(m *Match) ([]byte, error)) ([]byte, error) {
+	var ret []byte
+	last := 0
+	for k, loc := range matches {
+		b, err := repl(&Match{text: src, loc: loc, index: k, re: re})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(append(ret, src[last:loc[0]]...), b...)
+		last = loc[1]
+	}
+	return append(ret, src[last:]...), nil
+}
+
+// Index returns the number of the match among the successive matches of
+// the search, counting from zero.
+func (m *Match) Index() int {
+	return m.index
+}
+
+// Source returns the searched text held by the match, and its offset in
+// the searched text. The matches given to replacement functions hold the
+// whole text, with offset 0, and the others only the text of the match.
+func (m *Match) Source() (text string, offset int) {
+	return m.text, m.lo
+}
+
+// Span returns the bounds of the match in the searched text.
+func (m *Match) Span() (start, end int) {
+	return m.loc[0], m.loc[1]
+}
+
+// Matched reports whether group i participated in the match.
+// It reports false if there is no group i.
+func (m *Match) Matched(i int) bool {
+	return i >= 0 && 2*i+1 < len(m.loc) && m.loc[2*i] >= 0
+}
+
+// GroupSpan returns the bounds of group i in the searched text.
+// ok is false if the group did not participate in the match.
+func (m *Match) GroupSpan(i int) (start, end int, ok bool) {
+	if !m.Matched(i) {
+		return -1, -1, false
+	}
+	return m.loc[2*i], m.loc[2*i+1], true
+}
+
+// Group returns the text of group i.
+// ok is false if the group did not participate in the match.
+func (m *Match) Group(i int) (text string, ok bool) {
+	start, end, ok := m.GroupSpan(i)
+	if !ok {
+		return "", false
+	}
+	return m.text[start-m.lo : end-m.lo], true
+}
+
+// Named returns the text of the group with the given name.
+// ok is false if there is no such group or if it did not participate
+// in the match.
+func (m *Match) Named(name string) (text string, ok bool) {
+	for i, n := range m.re.subexpNames {
+		if i > 0 && n == name && m.Matched(i) {
+			return m.Group(i)
+		}
+	}
+	return "", false
+}
+
+// NamedMap returns the text of the named groups that participated in
+// the match, by name.
+func (m *Match) NamedMap() map[string]string {
+	ret := make(map[string]string)
+	for i, n := range m.re.subexpNames {
+		if i == 0 || n == "" {
+			continue
+		}
+		if text, ok := m.Group(i); ok {
+			if _, dup := ret[n]; !dup {
+				ret[n] = text
+			}
+		}
+	}
+	return ret
+}
+
+// Expand returns template with its variables replaced by the groups of
+// the match, as in the Expand method of the expression.
+func (m *Match) Expand(template string) string {
+	loc := make([]int, len(m.loc))
+	for i, v := range m.loc {
+		if v >= 0 {
+			v -= m.lo
+		}
+		loc[i] = v
+	}
+	return string(m.re.ExpandString(nil, template, m.text, loc))
+}
+
+// ExpandTemplate returns the expansion of t for the match.
+func (m *Match) ExpandTemplate(t *Template) string {
+	return string(m.AppendTemplate(nil, t))
+}
+
+// AppendTemplate appends the expansion of t for the match to dst and
+// returns the result.
+func (m *Match) AppendTemplate(dst []byte, t *Template) []byte {
+	e := expander{dst: dst, src: m.text, names: m.re.subexpNames, match: m.loc, lo: m.lo}
+	e.expand(t.items)
+	return e.dst
+}
+
+// String returns the text of the match.
+func (m *Match) String() string {
+	text, _ := m.Group(0)
+	return text
+}
+
+func (re *regexp) FindMatch(b []byte) *Match {
+	loc := re.FindSubmatchIndex(b)
+	if loc == nil {
+		return nil
+	}
+	return re.newMatch(b, loc)
+}
+
+func (re *regexp) FindStringMatch(s string) *Match {
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil
+	}
+	return re.newStringMatch(s, loc)
+}
+
+func (re *regexp) FindAllMatches(b []byte, n int) []*Match {
+	return re.newMatches(b, re.FindAllSubmatchIndex(b, n))
+}
+
+func (re *regexp) FindAllStringMatches(s string, n int) []*Match {
+	return re.newStringMatches(s, re.FindAllStringSubmatchIndex(s, n))
+}
+
+func (re *regexp) ReplaceAllSubmatchFunc(src []byte, repl func(m *Match) []byte) []byte {
+	ret, _ := re.ReplaceAllSubmatchFuncErr(src, func(m *Match) ([]byte, error) {
+		return repl(m), nil
+	})
+	return ret
+}
+
+func (re *regexp) ReplaceAllStringSubmatchFunc(src string, repl func(m *Match) string) string {
+	ret, _ := re.ReplaceAllStringSubmatchFuncErr(src, func(m *Match) (string, error) {
+		return repl(m), nil
+	})
+	return ret
+}
+
+func (re *regexp) ReplaceAllTemplate(src []byte, t *Template) []byte {
+	return re.ReplaceAllSubmatchFunc(src, func(m *Match) []byte {
+		return m.AppendTemplate(nil, t)
+	})
+}
+
+func (re *regexp) ReplaceAllStringTemplate(src string, t *Template) string {
+	return re.ReplaceAllStringSubmatchFunc(src, func(m *Match) string {
+		return string(m.AppendTemplate(nil, t))
+	})
+}
+
+func (re *regexp) ReplaceAllPreserveCase(src, repl []byte) []byte {
+	return re.ReplaceAllFunc(src, func(b []byte) []byte {
+		return []byte(PreserveCase(string(b), string(repl)))
+	})
+}
+
+func (re *regexp) ReplaceAllStringPreserveCase(src, repl string) string {
+	return re.ReplaceAllStringFunc(src, func(s string) string {
+		return PreserveCase(s, repl)
+	})
+}
+
+func (re *regexp) ReplaceAllSubmatchFuncErr(src []byte, repl func(m *Match) ([]byte, error)) ([]byte, error) {
+	return re.replaceMatches(string(src), re.all(src), repl)
+}
+
+func (re *regexp) ReplaceAllStringSubmatchFuncErr(src string, repl func(m *Match) (string, error)) (string, error) {
+	ret, err := re.replaceMatches(src, re.all(re.input(src)), func(m *Match) ([]byte, error) {
+		s, err := repl(m)
+		return []byte(s), err
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
+}
@@ -0,0 +1,113 @@
+package syntax
+
+// memoLimit bounds the number of memo entries recorded during a single search.
+// Once the limit is reached matching continues without recording.
+const memoLimit = 1 << 20
+
+// memoThreshold is the number of steps an attempt runs before it starts
+// recording explored states. Most matches finish well before that.
+const memoThreshold = 1 << 12
+
+// memoKeep is the largest memo table kept for reuse by later searches.
+const memoKeep = 1 << 14
+
+// maxCounters is the number of enclosing bounded loops a memo point
+// can have.
+const maxCounters = 4
+
+// memoKey identifies an explored state: the instruction, the position
+// and the iteration counts of the enclosing bounded loops.
+type memoKey struct {
+	pc     int
+	pos    int
+	counts [maxCounters]int
+}
+
+// memoTable records the states explored by a run, keyed to the stamp of
+// the run. A state reached again in the same run has either failed already
+// or is being explored by an enclosing path, so it cannot lead to a new match.
+type memoTable map[memoKey]uint32
+
+// visit records the state of i at pos and reports whether it has to be
+// explored. The states of cycle points are always recorded, as skipping
+// them changes the match.
+func (m *machine) visit(i *inst, pc, pos int, stamp uint32) bool {
+	if m.memo == nil {
+		if m.steps < memoThreshold && !i.cycle {
+			return true
+		}
+		m.memo, m.spare = m.spare, nil
+		if m.memo == nil {
+			m.memo = make(memoTable)
+		}
+	}
+	k := memoKey{pc: pc, pos: pos}
+	for n, r := range i.counters {
+		k.counts[n] = m.caps[r]
+	}
+	if s, ok := m.memo[k]; ok && s == stamp {
+		return false
+	}
+	if len(m.memo) < memoLimit || i.cycle {
+		m.memo[k] = stamp
+	}
+	return true
+}
+
+// next returns a stamp for a new run.
+func (m *machine) next() uint32 {
+	m.stamp++
+	return m.stamp
+}
+
+// markMemo keeps the memo points of p whose outcome only depends on
+// the state recorded in memoKey.
+//
+// Callouts can inspect the captures, so they disable memoization entirely.
+// A back reference depends on the captures as well, so memo points from
+// where one can be reached are dropped.
+func markMemo(p *prog) {
+	for _, i := range p.inst {
+		if i.op == opCall {
+			for pc := range p.inst {
+				p.inst[pc].memo = false
+			}
+			return
+		}
+	}
+	backRef := make([]bool, len(p.inst))
+	for changed := true; changed; {
+		changed = false
+		for pc := len(p.inst) - 1; pc >= 0; pc-- {
+			if backRef[pc] {
+				continue
+			}
+			if p.inst[pc].op == opBackRef || anySucc(p, pc, backRef) {
+				backRef[pc] = true
+				changed = true
+			}
+		}
+	}
+	for pc := range p.inst {
+		i := &p.inst[pc]
+		if backRef[pc] || len(i.counters) > maxCounters {
+			i.memo = false
+		}
+	}
+}
+
+// anySucc reports whether set holds any successor of the instruction at pc.
+func anySucc(p *prog, pc int, set []bool) bool {
+	i := &p.inst[pc]
+	switch i.op {
+	case opMatch:
+		return false
+	case opJmp, opCountNext:
+		return set[i.x]
+	case opSplit:
+		return set[i.x] || set[i.y]
+	case opAtomic, opLookahead, opLookbehind, opDelegate, opCount:
+		return set[pc+1] || set[i.x]
+	}
+	return set[pc+1]
+}
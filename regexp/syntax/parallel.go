@@ -0,0 +1,151 @@
+package syntax
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// minChunk is the smallest part of the text searched by a goroutine of
+// FindAllSubmatchIndexParallel.
+const minChunk = 1 << 16
+
+// chunk is a part of the text searched on its own goroutine.
+type chunk struct {
+	// lo and last are the first and the last start positions of the
+	// matches of the chunk.
+	lo, last int
+
+	// locs are the matches of an iteration started at lo, and capped
+	// is set if the iteration stopped before last.
+	locs   [][]int
+	capped bool
+}
+
+// chunks splits b into at most k chunks of at least minChunk bytes.
+// A chunk starts after a newline if there is one in the first half of
+// its nominal size, and at a rune boundary otherwise.
+func chunks(b []byte, k int) []chunk {
+	size := len(b) / k
+	if size < minChunk {
+		size = minChunk
+	}
+	var ret []chunk
+	for lo := 0; lo < len(b); {
+		next := lo + size
+		if next >= len(b) {
+			ret = append(ret, chunk{lo: lo, last: len(b)})
+			break
+		}
+		if i := bytes.IndexByte(b[next:min(next+size/2, len(b))], '\n'); i >= 0 {
+			next += i + 1
+		} else {
+			for next < len(b) && !utf8.RuneStart(b[next]) {
+				next++
+			}
+		}
+		if next == len(b) {
+			ret = append(ret, chunk{lo: lo, last: len(b)})
+			break
+		}
+		ret = append(ret, chunk{lo: lo, last: next - 1})
+		lo = next
+	}
+	return ret
+}
+
+func (re *regexp) FindAllSubmatchIndexParallel(b []byte, n int) [][]int {
+	parts := chunks(b, runtime.GOMAXPROCS(0))
+	// Inline functions may expect to be called in the order of the text.
+	if len(parts) < 2 || re.fixed || len(re.funcs) > 0 || n == 0 {
+		return re.FindAllSubmatchIndex(b, n)
+	}
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(p *chunk) {
+			defer wg.Done()
+			m := re.machine(nil, b, modeSubmatch)
+			defer re.put(m)
+			c := cursor{offset: p.lo, prev: -1}
+			for {
+				start, end, ok := re.next(m, &c, p.last, modeSubmatch)
+				if !ok {
+					break
+				}
+				if len(p.locs) == n {
+					p.capped = true
+					break
+				}
+				loc := make([]int, 0, re.prog.ncap*2)
+				p.locs = append(p.locs, m.appendLoc(loc, start, end, true))
+			}
+		}(&parts[i])
+	}
+	wg.Wait()
+	return re.merge(b, parts, n)
+}
+
+// merge joins the matches of the chunks into the sequence found by a
+// serial search.
+//
+// The iteration of a chunk is the serial one as long as the serial
+// iteration reaches the chunk before its first match. Otherwise a match
+// of the previous chunk extends into it, and the serial iteration is run
+// until it ends a match where the chunk does: both iterations continue
+// in the same way from there. It also resumes the iteration of a chunk
+// that was capped at n matches, if fewer were kept.
+func (re *regexp) merge(b []byte, parts []chunk, n int) [][]int {
+	var ret [][]int
+	m := re.machine(nil, b, modeSubmatch)
+	defer re.put(m)
+	c := cursor{prev: -1}
+	// serial appends the matches of the serial iteration in p to ret.
+	// If sync is set, it stops after a match that ends where one of p
+	// does, and returns the matches of p that follow it.
+	serial := func(p *chunk, sync bool) [][]int {
+		for n < 0 || len(ret) < n {
+			start, end, ok := re.next(m, &c, p.last, modeSubmatch)
+			if !ok {
+				break
+			}
+			loc := make([]int, 0, re.prog.ncap*2)
+			ret = append(ret, m.appendLoc(loc, start, end, true))
+			if !sync {
+				continue
+			}
+			i := sort.Search(len(p.locs), func(i int) bool {
+				return p.locs[i][1] >= end
+			})
+			if i < len(p.locs) && p.locs[i][1] == end {
+				return p.locs[i+1:]
+			}
+		}
+		return nil
+	}
+	for k := range parts {
+		p := &parts[k]
+		locs := p.locs
+		if c.offset > p.lo {
+			locs = serial(p, true)
+		} else if len(locs) > 0 && c.prev == p.lo && locs[0][0] == p.lo && locs[0][1] == p.lo {
+			// The serial iteration skips an empty match right after
+			// the previous match.
+			locs = locs[1:]
+		}
+		ret = append(ret, locs...)
+		if len(locs) > 0 {
+			end := locs[len(locs)-1][1]
+			c = cursor{offset: end, prev: end}
+		}
+		if p.capped {
+			serial(p, false)
+		}
+		if n >= 0 && len(ret) >= n {
+			return ret[:n]
+		}
+	}
+	return ret
+}
@@ -13,14 +13,27 @@ import (
 type parser struct {
 	groupIndex  int
 	subexpNames []string
+
+	// pattern is the expression being parsed and runes its runes.
+	pattern string
+	runes   []rune
+
+	// backrefs are the back references of the pattern.
+	backrefs []backrefUse
+
+	// In check mode, errors are collected in diags rather than ending
+	// the parsing, and so are warnings if warnings is set.
+	check    bool
+	warnings bool
+	diags    []Diagnostic
 }
 
 func (p *parser) parse(reg []byte, flags syntax.Flags) (n node, subexp []string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if e, ok := r.(syntax.Error); ok {
-				err = fmt.Errorf("error parsing regexp: %s", e.Error())
-			} else {
+			if e, ok := r.(*Error); ok {
+				err = e
+			} else if _, ok := r.(recovery); !ok {
 				panic(r)
 			}
 		}
@@ -28,20 +41,35 @@ func (p *parser) parse(reg []byte, flags syntax.Flags) (n node, subexp []string,
 
 	p.groupIndex = 0
 	p.subexpNames = nil
+	p.backrefs = nil
+	p.pattern = string(reg)
 
 	runes := make([]rune, 0, len(reg))
-	b := reg
-	for len(b) > 0 {
-		r, size := utf8.DecodeRune(b)
-		if r == utf8.RuneError {
-			panic(newErrorBytes(syntax.ErrInvalidUTF8, reg))
+	for i := 0; i < len(reg); {
+		r, size := utf8.DecodeRune(reg[i:])
+		if r == utf8.RuneError && size == 1 {
+			panic(&Error{
+				Code:       syntax.ErrInvalidUTF8,
+				Expr:       string(reg[i:]),
+				Pattern:    p.pattern,
+				Offset:     i,
+				RuneOffset: len(runes),
+			})
 		}
 		runes = append(runes, r)
-		b = b[size:]
+		i += size
 	}
+	p.runes = runes
 
 	p.groupIndex = -1
-	return p.group(runes, flags), p.subexpNames, nil
+	n = p.group(runes, flags)
+	// Back references can refer to groups that follow them.
+	for _, b := range p.backrefs {
+		if !p.defined(b) {
+			p.report(ErrUndefinedBackref, b.start, b.end)
+		}
+	}
+	return n, p.subexpNames, nil
 }
 
 func parseBackref(exp []rune) (string, int) {
@@ -100,9 +128,10 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 	r := runes
 	indexed := true
 	wrapper := wrapperNone
+	bar := 0 // the offset of the last '|'
 
-	exp := append(append([]rune{'('}, runes...), ')')
-	if len(r) >= 2 && r[0] == '?' {
+	// The whole pattern, at offset 0, is not a group body and has no kind.
+	if p.pos(runes) > 0 && len(r) >= 2 && r[0] == '?' {
 		switch {
 		case r[1] == '>':
 			g.Atomic = true
@@ -119,7 +148,7 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 			r = r[2:]
 		case r[1] == '{':
 			if len(runes) <= 3 || runes[len(runes)-1] != '}' {
-				panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+				p.failGroup(ErrInvalidFunctionCall, runes)
 			}
 			var name []byte
 			for _, r := range runes[2 : len(runes)-1] {
@@ -157,7 +186,7 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 					}
 				}
 				if len(name) == 0 {
-					panic(newErrorRunes(syntax.ErrInvalidNamedCapture, exp))
+					p.failGroup(syntax.ErrInvalidNamedCapture, runes)
 				}
 
 				r = r[len(name)+1:]
@@ -171,7 +200,7 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 				g.Name = string(rbytes)
 
 			} else {
-				panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+				p.failGroup(syntax.ErrInvalidPerlOp, runes)
 			}
 		default:
 			f := 1
@@ -196,10 +225,10 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 					if f == 1 {
 						f = -1
 					} else {
-						panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+						p.failGroup(syntax.ErrInvalidPerlOp, runes)
 					}
 				default:
-					panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+					p.failGroup(syntax.ErrInvalidPerlOp, runes)
 				}
 			}
 			if !internal {
@@ -216,229 +245,251 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 		p.subexpNames = append(p.subexpNames, g.Name)
 	}
 
-	for len(r) > 0 {
-		rx := runes[:len(runes)-len(r)]
-		if meta {
-			meta = false
-			switch {
-			case r[0] == '0':
-				n, _ := p.fetchLiteral([]rune{rune(0)}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case '1' <= r[0] && r[0] <= '7':
-				size := 1
-				oct := []int{int(r[0] - '0'), 0, 0}
-				if len(r) >= 2 && '0' <= r[1] && r[1] <= '7' {
-					oct = append([]int{int(r[1] - '0')}, oct...)
-					size++
-				}
-				if len(r) >= 3 && '0' <= r[2] && r[2] <= '7' {
-					oct = append([]int{int(r[2] - '0')}, oct...)
-					size++
-				}
-				i := oct[0] + oct[1]*8 + oct[2]*64
-				n, _ := p.fetchLiteral([]rune{rune(i)}, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
-			case r[0] == 'x':
-				n, size := p.fetchHexCode(r, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
-			case r[0] == 'k':
-				name, size := parseBackref(r[1:])
-				if size > 0 {
-					n := backRefNode{Flags: flags}
-					idx, err := strconv.Atoi(name)
-					if err == nil && strconv.Itoa(idx) == name {
-						n.Index = idx
+	// In check mode an error skips the text it covers, and the group is
+	// parsed on after it.
+	items := func() {
+		for len(r) > 0 {
+			if meta {
+				meta = false
+				switch {
+				case r[0] == '0':
+					n, _ := p.fetchLiteral([]rune{rune(0)}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case '1' <= r[0] && r[0] <= '7':
+					size := 1
+					oct := []int{int(r[0] - '0'), 0, 0}
+					if len(r) >= 2 && '0' <= r[1] && r[1] <= '7' {
+						oct = append([]int{int(r[1] - '0')}, oct...)
+						size++
+					}
+					if len(r) >= 3 && '0' <= r[2] && r[2] <= '7' {
+						oct = append([]int{int(r[2] - '0')}, oct...)
+						size++
+					}
+					i := oct[0] + oct[1]*8 + oct[2]*64
+					n, _ := p.fetchLiteral([]rune{rune(i)}, flags)
+					r = r[size:]
+					g.N = append(g.N, n)
+				case r[0] == 'x':
+					n, size := p.fetchHexCode(r, flags)
+					r = r[size:]
+					g.N = append(g.N, n)
+				case r[0] == 'k':
+					name, size := parseBackref(r[1:])
+					if size > 0 {
+						n := backRefNode{Flags: flags}
+						idx, err := strconv.Atoi(name)
+						if err == nil && strconv.Itoa(idx) == name {
+							n.Index = idx
+						} else {
+							n.Name = name
+						}
+						p.backrefs = append(p.backrefs, backrefUse{
+							name: n.Name, index: n.Index,
+							start: p.pos(r) - 1, end: p.pos(r) + size + 1,
+						})
+						r = r[size+1:]
+						g.N = append(g.N, n)
 					} else {
-						n.Name = name
+						p.fail(ErrInvalidBackref, p.pos(r)-1, p.pos(r)+1)
 					}
-					r = r[size+1:]
+				case r[0] == 'd':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							digitsMatcher{},
+						},
+					}
+					r = r[1:]
 					g.N = append(g.N, n)
-				} else {
-					panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, r[0])))
-				}
-			case r[0] == 'd':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						digitsMatcher{},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'D':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						reverseMatcher{M: digitsMatcher{}},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 's':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						whitespaceMatcher{},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'S':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						reverseMatcher{M: whitespaceMatcher{}},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'w':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						wordMatcher{},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'W':
-				n := charNode{
-					Flags: flags,
-					Matcher: []charNodeMatcher{
-						reverseMatcher{M: wordMatcher{}},
-					},
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'p' || r[0] == 'P':
-				m, size := p.fetchUnicodeClass(r)
-				n := charNode{
-					Flags:   flags,
-					Matcher: []charNodeMatcher{m},
-				}
-				r = r[size:]
-				g.N = append(g.N, n)
-			case r[0] == 'A':
-				n := beginNode{Flags: flags}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'z':
-				n := endNode{Flags: flags}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'a':
-				n, _ := p.fetchLiteral([]rune{'\a'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'f':
-				n, _ := p.fetchLiteral([]rune{'\f'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 't':
-				n, _ := p.fetchLiteral([]rune{'\t'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'n':
-				n, _ := p.fetchLiteral([]rune{'\n'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'r':
-				n, _ := p.fetchLiteral([]rune{'\r'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'v':
-				n, _ := p.fetchLiteral([]rune{'\v'}, flags)
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'Q':
-				l := 1
-				for i := 1; i < len(r); i++ {
-					if i+1 < len(r) && r[i] == '\\' && r[i+1] == 'E' {
-						l += 2
-						break
+				case r[0] == 'D':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							reverseMatcher{M: digitsMatcher{}},
+						},
 					}
-					n, _ := p.fetchLiteral(r[i:], flags)
+					r = r[1:]
 					g.N = append(g.N, n)
-					l++
-				}
-				r = r[l:]
-			case r[0] == 'E':
-				panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, r[0])))
-			case r[0] == 'b':
-				n := wordBoundaryNode{}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case r[0] == 'B':
-				n := wordBoundaryNode{Reversed: true}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case isASCIIPunct(r[0]):
-				n, size := p.fetchLiteral(r, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
-			default:
-				panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, r[0])))
-			}
-		} else {
-			switch r[0] {
-			case '\\':
-				meta = true
-				r = r[1:]
-			case '.':
-				n := anyCharNode{
-					Flags: flags,
-				}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case '^':
-				n := beginNode{Flags: flags, Line: true}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case '$':
-				n := endNode{Flags: flags, Line: true}
-				r = r[1:]
-				g.N = append(g.N, n)
-			case '?', '*', '+': // repeat
-				n, size := p.fetchRepeat(r, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
-			case '|':
-				r = r[1:]
-				g.N = append(g.N, alterNode{})
-			case '[':
-				n, size := p.fetchCharClass(r, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
-			case '{':
-				n, size := p.fetchRange(r)
-				r = r[size:]
-				g.N = append(g.N, n)
-			case '(': // group
-				n, size := p.fetchGroup(r, flags)
-				if n == nil {
-					panic(newErrorRunes(syntax.ErrMissingParen, append(rx, r...)))
+				case r[0] == 's':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							whitespaceMatcher{},
+						},
+					}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'S':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							reverseMatcher{M: whitespaceMatcher{}},
+						},
+					}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'w':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							wordMatcher{},
+						},
+					}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'W':
+					n := charNode{
+						Flags: flags,
+						Matcher: []charNodeMatcher{
+							reverseMatcher{M: wordMatcher{}},
+						},
+					}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'p' || r[0] == 'P':
+					m, size := p.fetchUnicodeClass(r)
+					n := charNode{
+						Flags:   flags,
+						Matcher: []charNodeMatcher{m},
+					}
+					r = r[size:]
+					g.N = append(g.N, n)
+				case r[0] == 'A':
+					n := beginNode{Flags: flags}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'z':
+					n := endNode{Flags: flags}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'a':
+					n, _ := p.fetchLiteral([]rune{'\a'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'f':
+					n, _ := p.fetchLiteral([]rune{'\f'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 't':
+					n, _ := p.fetchLiteral([]rune{'\t'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'n':
+					n, _ := p.fetchLiteral([]rune{'\n'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'r':
+					n, _ := p.fetchLiteral([]rune{'\r'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'v':
+					n, _ := p.fetchLiteral([]rune{'\v'}, flags)
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'Q':
+					l := 1
+					for i := 1; i < len(r); i++ {
+						if i+1 < len(r) && r[i] == '\\' && r[i+1] == 'E' {
+							l += 2
+							break
+						}
+						n, _ := p.fetchLiteral(r[i:], flags)
+						g.N = append(g.N, n)
+						l++
+					}
+					r = r[l:]
+				case r[0] == 'E':
+					p.failEscape(r, 1)
+				case r[0] == 'b':
+					n := wordBoundaryNode{}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case r[0] == 'B':
+					n := wordBoundaryNode{Reversed: true}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case isASCIIPunct(r[0]):
+					n, size := p.fetchLiteral(r, flags)
+					r = r[size:]
+					g.N = append(g.N, n)
+				default:
+					p.failEscape(r, 1)
 				}
-				r = r[size:]
-				if fn, ok := n.(flagNode); ok {
-					flags = applyFlags(flags, fn.Flags)
-				} else {
+			} else {
+				switch r[0] {
+				case '\\':
+					meta = true
+					r = r[1:]
+				case '.':
+					n := anyCharNode{
+						Flags: flags,
+					}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case '^':
+					n := beginNode{Flags: flags, Line: true}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case '$':
+					n := endNode{Flags: flags, Line: true}
+					r = r[1:]
+					g.N = append(g.N, n)
+				case '?', '*', '+': // repeat
+					n, size := p.fetchRepeat(r, flags)
+					r = r[size:]
+					g.N = append(g.N, n)
+				case '|':
+					if len(g.N) == 0 || isAlter(g.N[len(g.N)-1]) {
+						p.warn(WarnEmptyAlternative, p.pos(r), p.pos(r)+1)
+					}
+					bar = p.pos(r)
+					r = r[1:]
+					g.N = append(g.N, alterNode{})
+				case '[':
+					n, size := p.fetchCharClass(r, flags)
+					r = r[size:]
+					g.N = append(g.N, n)
+				case '{':
+					n, size := p.fetchRange(r)
+					r = r[size:]
+					g.N = append(g.N, n)
+				case '(': // group
+					n, size := p.fetchGroup(r, flags)
+					if n == nil {
+						// The rest is parsed as if the opening of the group was
+						// not there.
+						p.report(syntax.ErrMissingParen, p.pos(r), p.pos(r)+len(r))
+						r = r[groupOpening(r):]
+						continue
+					}
+					r = r[size:]
+					if fn, ok := n.(flagNode); ok {
+						flags = applyFlags(flags, fn.Flags)
+					} else {
+						g.N = append(g.N, n)
+					}
+				case ')':
+					p.fail(syntax.ErrUnexpectedParen, p.pos(r), p.pos(r)+1)
+				default:
+					n, size := p.fetchLiteral(r, flags)
+					r = r[size:]
 					g.N = append(g.N, n)
 				}
-			case ')':
-				panic(newErrorRunes(syntax.ErrUnexpectedParen, append(rx, r...)))
-			default:
-				n, size := p.fetchLiteral(r, flags)
-				r = r[size:]
-				g.N = append(g.N, n)
 			}
 		}
 	}
+	for resume := p.try(items); resume >= 0; resume = p.try(items) {
+		r = runes[min(max(resume, p.pos(r)+1)-p.pos(runes), len(runes)):]
+		meta = false
+	}
 
+	if len(g.N) > 0 && isAlter(g.N[len(g.N)-1]) {
+		p.warn(WarnEmptyAlternative, bar, bar+1)
+	}
 	if meta {
-		panic(newErrorRunes(syntax.ErrTrailingBackslash, runes))
+		p.report(syntax.ErrTrailingBackslash, p.pos(runes)+len(runes)-1, p.pos(runes)+len(runes))
 	}
 
 	g.N = p.concatRepetitions(g.N)
@@ -455,12 +506,12 @@ func (p *parser) group(runes []rune, flags syntax.Flags) node {
 		return lookaheadNode{N: g, Negative: true}
 	case wrapperLookbehind:
 		if max < 0 {
-			panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+			p.reportGroup(ErrUnboundedLookbehind, runes)
 		}
 		return lookbehindNode{N: g}
 	case wrapperNegativeLookbehind:
 		if max < 0 {
-			panic(newErrorRunes(syntax.ErrInvalidPerlOp, exp))
+			p.reportGroup(ErrUnboundedLookbehind, runes)
 		}
 		return lookbehindNode{N: g, Negative: true}
 	}
@@ -477,7 +528,7 @@ func (p *parser) fetchUnicodeClass(runes []rune) (charNodeMatcher, int) {
 	var m charNodeMatcher
 	size := 0
 	if len(runes) < 2 {
-		panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes[0])))
+		p.failEscape(runes, 1)
 	}
 	if runes[1] == '{' {
 		var name []byte
@@ -491,12 +542,12 @@ func (p *parser) fetchUnicodeClass(runes []rune) (charNodeMatcher, int) {
 			}
 		}
 		if size == 0 {
-			panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes...)))
+			p.failEscape(runes, len(runes))
 		}
 		if c, ok := unicode.Scripts[string(name)]; ok {
 			m = &unicodeMatcher{R: c}
 		} else {
-			panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes[:2]...)))
+			p.failEscape(runes, size)
 		}
 	} else {
 		var lit [utf8.UTFMax]byte
@@ -505,7 +556,7 @@ func (p *parser) fetchUnicodeClass(runes []rune) (charNodeMatcher, int) {
 			m = &unicodeMatcher{R: c}
 			size = 2
 		} else {
-			panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes[:2]...)))
+			p.failEscape(runes, 2)
 		}
 	}
 	if runes[0] == 'P' {
@@ -518,7 +569,7 @@ func (p *parser) fetchHexCode(runes []rune, flags syntax.Flags) (node, int) {
 	var hex []byte
 	size := 0
 	if len(runes) < 3 {
-		panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes...)))
+		p.failEscape(runes, len(runes))
 	}
 	if runes[1] == '{' {
 		for i, r := range runes[2:] {
@@ -527,24 +578,24 @@ func (p *parser) fetchHexCode(runes []rune, flags syntax.Flags) (node, int) {
 			} else if isASCIIXdigit(r) {
 				hex = append(hex, byte(r))
 			} else {
-				panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes[:i+1]...)))
+				p.failEscape(runes, i+3)
 			}
 		}
 		if size == 0 {
-			panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes...)))
+			p.failEscape(runes, len(runes))
 		}
 	} else {
 		if isASCIIXdigit(runes[1]) && isASCIIXdigit(runes[2]) {
 			hex = []byte{byte(runes[1]), byte(runes[2])}
 			size = 3
 		} else {
-			panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes[:2]...)))
+			p.failEscape(runes, 3)
 		}
 	}
 	i := 0
 	fmt.Sscanf(string(hex), "%x", &i)
 	if rune(i) > unicode.MaxRune {
-		panic(newErrorRunes(syntax.ErrInvalidEscape, append([]rune{'\\'}, runes...)))
+		p.failEscape(runes, size)
 	}
 	n, _ := p.fetchLiteral([]rune{rune(i)}, flags)
 	return n, size
@@ -564,7 +615,7 @@ func (p *parser) fetchCharClass(runes []rune, flags syntax.Flags) (node, int) {
 	l := 1
 	r := runes[1:]
 	if len(r) < 2 {
-		panic(newErrorRunes(syntax.ErrMissingBracket, runes))
+		p.fail(syntax.ErrMissingBracket, p.pos(runes), p.pos(runes)+len(runes))
 	}
 
 	reversed := false
@@ -595,7 +646,7 @@ func (p *parser) fetchCharClass(runes []rune, flags syntax.Flags) (node, int) {
 	}
 
 	if len(exp) == 0 {
-		panic(newErrorRunes(syntax.ErrMissingBracket, runes))
+		p.fail(syntax.ErrMissingBracket, p.pos(runes), p.pos(runes)+len(runes))
 	}
 
 	n := charNode{
@@ -742,7 +793,7 @@ func (p *parser) parseCharClass(exp []rune) []charNodeMatcher {
 				case "^space":
 					m = append(m, reverseMatcher{M: whitespaceMatcher{}})
 				default:
-					panic(newErrorRunes(syntax.ErrInvalidCharRange, r[:offset+1]))
+					p.fail(syntax.ErrInvalidCharRange, p.pos(r), p.pos(r)+offset+1)
 				}
 				r = r[offset:]
 			} else {
@@ -750,7 +801,7 @@ func (p *parser) parseCharClass(exp []rune) []charNodeMatcher {
 			}
 		} else if len(r) >= 3 && r[1] == '-' {
 			if r[0] > r[2] {
-				panic(newErrorRunes(syntax.ErrInvalidCharRange, r[:3]))
+				p.fail(syntax.ErrInvalidCharRange, p.pos(r), p.pos(r)+3)
 			}
 			ranges = append(ranges, rangeMatcher{B: r[0], E: r[2]})
 			r = r[2:]
@@ -825,7 +876,7 @@ func (p *parser) fetchRange(runes []rune) (node, int) {
 				}
 			}
 			if (e >= 0 && e < b) || b > 1000 || e > 1000 {
-				panic(newErrorRunes(syntax.ErrInvalidRepeatSize, runes[:l]))
+				p.fail(syntax.ErrInvalidRepeatSize, p.pos(runes), p.pos(runes)+l)
 			}
 			return repeatNode{
 				Min: b, Max: e,
@@ -928,15 +979,63 @@ func (p *parser) fetchGroup(runes []rune, flags syntax.Flags) (node, int) {
 	return nil, 0
 }
 
+// groupOpening returns the length of the opening of the group at the start
+// of runes: the parenthesis and the text telling the kind of the group,
+// such as "(?<=", "(?P<name>" or "(?i:".
+func groupOpening(runes []rune) int {
+	if len(runes) < 2 || runes[1] != '?' {
+		return 1
+	}
+	r := runes[2:]
+	if len(r) == 0 {
+		return 2
+	}
+	switch {
+	case strings.ContainsRune(">:#=!{", r[0]):
+		return 3
+	case len(r) >= 2 && r[0] == '<' && (r[1] == '=' || r[1] == '!'):
+		return 4
+	case len(r) >= 2 && r[0] == 'P' && r[1] == '<':
+		for i, e := range r[2:] {
+			if e == '>' {
+				return 5 + i
+			}
+			if e != '_' &&
+				!('a' <= e && e <= 'z') &&
+				!('A' <= e && e <= 'Z') &&
+				!('0' <= e && e <= '9') {
+				break
+			}
+		}
+		return 4
+	}
+	for i, e := range r {
+		if e == ':' {
+			return 3 + i
+		}
+		if !strings.ContainsRune("imsU-", e) {
+			return 2 + i
+		}
+	}
+	return len(runes)
+}
+
 func (p *parser) concatRepetitions(nodes []node) []node {
 	r := []node{}
 	for _, n := range nodes {
 		if rn, ok := n.(repeatNode); ok {
-			if len(r) == 0 {
-				panic(newErrorRunes(syntax.ErrMissingRepeatArgument, rn.Exp))
+			// In check mode the faulty operator is dropped. A bar is not an
+			// operand either: the alternatives are only split apart later.
+			if len(r) == 0 || isAlter(r[len(r)-1]) {
+				p.report(syntax.ErrMissingRepeatArgument, p.pos(rn.Exp), p.pos(rn.Exp)+len(rn.Exp))
+				continue
 			}
 			if nrn, ok := r[len(r)-1].(repeatNode); ok {
-				panic(newErrorRunes(syntax.ErrInvalidRepeatOp, append(nrn.Exp, rn.Exp...)))
+				p.report(syntax.ErrInvalidRepeatOp, p.pos(nrn.Exp), p.pos(rn.Exp)+len(rn.Exp))
+				continue
+			}
+			if g, ok := r[len(r)-1].(groupNode); ok && !g.Atomic && (rn.Max < 0 || rn.Max > 1) && hasRepeat(g) {
+				p.warn(WarnNestedQuantifier, p.pos(rn.Exp), p.pos(rn.Exp)+len(rn.Exp))
 			}
 			rn.N = r[len(r)-1]
 			if any, ok := rn.N.(anyCharNode); ok {
@@ -0,0 +1,408 @@
+package syntax
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// prefilter finds the literals one of which every match contains.
+type prefilter struct {
+	lits [][]byte
+
+	// dist is the largest distance between the start of a match and the
+	// start of its required literal, or -1 if it is unbounded.
+	dist int
+
+	// fold is set if the literals are matched ignoring ASCII case.
+	// They are stored in lower case.
+	fold bool
+
+	// rare is the index of the least frequent byte of a single literal.
+	rare int
+	ac   *ahoCorasick
+}
+
+// firstSet is the set of bytes a match can start with.
+type firstSet [256]bool
+
+// newFirstSet returns the first set of n, or nil if a match of n can
+// start with any byte.
+func newFirstSet(n node) *firstSet {
+	f := &firstSet{}
+	if firstBytes(n, (*[256]bool)(f)) {
+		return nil
+	}
+	for _, ok := range f {
+		if !ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// skip returns the first position at or after i that can start a match,
+// or len(b) if there is none. Only the positions reached by decoding
+// runes from i are considered.
+func (f *firstSet) skip(b []byte, i int) int {
+	for j := i; j < len(b); j++ {
+		if !f[b[j]] {
+			continue
+		}
+		if utf8.RuneStart(b[j]) {
+			return j
+		}
+		// A continuation byte is only decoded on its own if it is not
+		// part of a valid rune.
+		inside := false
+		for p := j - 1; p >= i && p > j-utf8.UTFMax; p-- {
+			if utf8.RuneStart(b[p]) {
+				if _, size := utf8.DecodeRune(b[p:]); p+size > j {
+					j = p + size - 1
+					inside = true
+				}
+				break
+			}
+		}
+		if !inside {
+			return j
+		}
+	}
+	return len(b)
+}
+
+// requirement is a set of literals one of which a node always matches.
+type requirement struct {
+	lits [][]byte
+	dist int
+	fold bool
+}
+
+// newPrefilter returns the prefilter of n, or nil if matches of n
+// do not require any literal.
+func newPrefilter(n node) *prefilter {
+	r, ok := required(n)
+	if !ok {
+		return nil
+	}
+	p := &prefilter{lits: r.lits, dist: r.dist, fold: r.fold}
+	if p.fold {
+		p.lits = make([][]byte, len(r.lits))
+		for i, l := range r.lits {
+			p.lits[i] = bytes.Map(toLowerASCII, l)
+		}
+	}
+	if len(p.lits) == 1 {
+		p.rare = rareByte(p.lits[0])
+	} else {
+		p.ac = newAhoCorasick(p.lits, p.fold)
+	}
+	return p
+}
+
+// index returns the smallest index at or after i where one of the literals
+// starts, or -1 if there is none.
+func (p *prefilter) index(b []byte, i int) int {
+	if p.ac != nil {
+		return p.ac.index(b, i)
+	}
+	lit := p.lits[0]
+	c := lit[p.rare]
+	fold := p.fold && 'a' <= c && c <= 'z'
+	for j := i + p.rare; j < len(b); j++ {
+		if fold {
+			// Both cases have to be looked for, so scan the bytes
+			// directly rather than searching twice.
+			for j < len(b) && b[j]|0x20 != c {
+				j++
+			}
+			if j == len(b) {
+				return -1
+			}
+		} else {
+			k := bytes.IndexByte(b[j:], c)
+			if k < 0 {
+				return -1
+			}
+			j += k
+		}
+		s := j - p.rare
+		if s+len(lit) <= len(b) && p.equal(b[s:s+len(lit)], lit) {
+			return s
+		}
+	}
+	return -1
+}
+
+// equal reports whether b is the literal lit.
+func (p *prefilter) equal(b, lit []byte) bool {
+	if !p.fold {
+		return bytes.Equal(b, lit)
+	}
+	for i, c := range b {
+		if byte(toLowerASCII(rune(c))) != lit[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// required returns the literals one of which every match of n contains.
+func required(n node) (requirement, bool) {
+	switch e := n.(type) {
+	case literalNode:
+		if len(e.L) == 0 {
+			return requirement{}, false
+		}
+		if e.Flags&syntax.FoldCase == 0 {
+			return requirement{lits: [][]byte{e.L}}, true
+		}
+		lits, ok := foldVariants(e.L)
+		return requirement{lits: lits, fold: true}, ok
+	case groupNode:
+		var best requirement
+		found := false
+		dist := 0
+		for _, c := range e.N {
+			if r, ok := required(c); ok {
+				if dist < 0 || r.dist < 0 {
+					r.dist = -1
+				} else {
+					r.dist += dist
+				}
+				if !found || better(r, best) {
+					best, found = r, true
+				}
+			}
+			if _, max := c.MinMax(); max < 0 || dist < 0 {
+				dist = -1
+			} else {
+				dist += max
+			}
+		}
+		return best, found
+	case alterNode:
+		var all requirement
+		for _, c := range e.N {
+			if c == nil {
+				return requirement{}, false
+			}
+			r, ok := required(c)
+			if !ok || len(all.lits)+len(r.lits) > maxRequired {
+				return requirement{}, false
+			}
+			if all.dist >= 0 && (r.dist < 0 || r.dist > all.dist) {
+				all.dist = r.dist
+			}
+			all.lits = append(all.lits, r.lits...)
+			all.fold = all.fold || r.fold
+		}
+		return all, true
+	case repeatNode:
+		if e.Min == 0 {
+			return requirement{}, false
+		}
+		return required(e.N)
+	}
+	return requirement{}, false
+}
+
+// maxRequired bounds the number of literals of a requirement.
+const maxRequired = 64
+
+// foldVariants returns the spellings of lit under Unicode case folding,
+// up to ASCII case which the search ignores. It fails if there are more
+// than maxRequired of them.
+func foldVariants(lit []byte) ([][]byte, bool) {
+	vars := [][]byte{nil}
+	for len(lit) > 0 {
+		r, size := utf8.DecodeRune(lit)
+		lit = lit[size:]
+
+		var encs [][]byte
+		add := func(r rune) {
+			var buf [utf8.UTFMax]byte
+			enc := bytes.Map(toLowerASCII, buf[:utf8.EncodeRune(buf[:], r)])
+			for _, e := range encs {
+				if bytes.Equal(e, enc) {
+					return
+				}
+			}
+			encs = append(encs, enc)
+		}
+		add(r)
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			add(f)
+		}
+		if len(vars)*len(encs) > maxRequired {
+			return nil, false
+		}
+
+		next := make([][]byte, 0, len(vars)*len(encs))
+		for _, v := range vars {
+			for _, e := range encs {
+				next = append(next, append(append([]byte(nil), v...), e...))
+			}
+		}
+		vars = next
+	}
+	return vars, true
+}
+
+func toLowerASCII(r rune) rune {
+	if 'A' <= r && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+	return r
+}
+
+// better reports whether a is a better requirement than b:
+// one that allows skipping, then one with longer literals,
+// then one with fewer literals.
+func better(a, b requirement) bool {
+	if (a.dist >= 0) != (b.dist >= 0) {
+		return a.dist >= 0
+	}
+	if la, lb := shortest(a.lits), shortest(b.lits); la != lb {
+		return la > lb
+	}
+	return len(a.lits) < len(b.lits)
+}
+
+func shortest(lits [][]byte) int {
+	n := -1
+	for _, l := range lits {
+		if n < 0 || len(l) < n {
+			n = len(l)
+		}
+	}
+	return n
+}
+
+// rareByte returns the index of the byte of lit expected to be the least
+// frequent in text.
+func rareByte(lit []byte) int {
+	best := 0
+	for i, c := range lit {
+		if byteRank(c) < byteRank(lit[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// byteRank estimates how frequent c is in text, from 0 for rare bytes
+// to 255 for the most common ones.
+func byteRank(c byte) int {
+	const letters = "etaoinshrdlcumwfgypbvkjxqz"
+	switch {
+	case c == ' ':
+		return 255
+	case 'a' <= c && c <= 'z':
+		return 250 - bytes.IndexByte([]byte(letters), c)*4
+	case 'A' <= c && c <= 'Z':
+		return 150 - bytes.IndexByte([]byte(letters), c+'a'-'A')*4
+	case '0' <= c && c <= '9':
+		return 120
+	case c == '\n' || c == '\t' || c == '\r':
+		return 160
+	case 0x80 <= c && c < 0xC0:
+		// Continuation bytes, the most common in non-ASCII text.
+		return 200
+	case c == 0xE3:
+		// The lead byte of most Japanese and Chinese characters.
+		return 230
+	case c >= 0xC0:
+		return 90
+	case c < ' ' || c == 0x7F:
+		return 10
+	}
+	return 60
+}
+
+// ahoCorasick finds the occurrences of a set of literals in a single pass.
+type ahoCorasick struct {
+	next [][256]int32
+
+	// out is the length of the longest literal ending at a state, or 0.
+	out    []int
+	maxLen int
+}
+
+// newAhoCorasick builds the automaton of lits. If fold is set, the literals
+// are in lower case and upper case letters of the input are matched as
+// their lower case.
+func newAhoCorasick(lits [][]byte, fold bool) *ahoCorasick {
+	a := &ahoCorasick{next: make([][256]int32, 1), out: []int{0}}
+	for _, l := range lits {
+		s := int32(0)
+		for _, c := range l {
+			if a.next[s][c] == 0 {
+				a.next = append(a.next, [256]int32{})
+				a.out = append(a.out, 0)
+				a.next[s][c] = int32(len(a.next) - 1)
+			}
+			s = a.next[s][c]
+		}
+		a.out[s] = len(l)
+		if len(l) > a.maxLen {
+			a.maxLen = len(l)
+		}
+	}
+
+	// Compute the failure links breadth first and turn the trie into
+	// a complete automaton. The failure link of a state is the longest
+	// proper suffix of its string that is also in the trie.
+	fail := make([]int32, len(a.next))
+	var queue []int32
+	for c := 0; c < 256; c++ {
+		if s := a.next[0][c]; s != 0 {
+			queue = append(queue, s)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if a.out[s] == 0 {
+			a.out[s] = a.out[fail[s]]
+		}
+		for c := 0; c < 256; c++ {
+			t := a.next[s][c]
+			if t == 0 {
+				a.next[s][c] = a.next[fail[s]][c]
+				continue
+			}
+			if s != 0 {
+				fail[t] = a.next[fail[s]][c]
+			}
+			queue = append(queue, t)
+		}
+	}
+	if fold {
+		for s := range a.next {
+			for c := 'A'; c <= 'Z'; c++ {
+				a.next[s][c] = a.next[s][c+'a'-'A']
+			}
+		}
+	}
+	return a
+}
+
+// index returns the smallest index at or after i where one of the literals
+// starts, or -1 if there is none.
+func (a *ahoCorasick) index(b []byte, i int) int {
+	s := int32(0)
+	start := -1
+	for j := i; j < len(b); j++ {
+		s = a.next[s][b[j]]
+		if l := a.out[s]; l != 0 && (start < 0 || j-l+1 < start) {
+			start = j - l + 1
+		}
+		// A literal starting before start would have ended by now.
+		if start >= 0 && j-start+1 >= a.maxLen {
+			break
+		}
+	}
+	return start
+}
@@ -0,0 +1,260 @@
+package syntax
+
+import (
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// readerChunk is the number of bytes read at a time from a stream.
+const readerChunk = 4096
+
+// reader buffers the text of a stream, read either as runes from r or
+// as bytes from src. Positions in buf are offset by base from the
+// positions in the stream.
+//
+// The buffer always ends with a whole rune, so that matching at its end
+// can tell whether it needs more text.
+type reader struct {
+	r    io.RuneReader
+	src  io.Reader
+	buf  []byte
+	base int
+	eof  bool
+	err  error
+
+	// keep is the number of bytes kept before the current attempt.
+	keep int
+
+	// If w is set, the text before out has been written to it.
+	w   io.Writer
+	out int
+}
+
+// fill reads at least n more bytes unless the stream ends first.
+func (rd *reader) fill(n int) {
+	want := len(rd.buf) + n
+	if rd.src == nil {
+		for !rd.eof && len(rd.buf) < want {
+			r, size, err := rd.r.ReadRune()
+			if err != nil {
+				// As with the built-in engine, an error ends the text.
+				rd.eof = true
+				break
+			}
+			if r == utf8.RuneError && size == 1 {
+				// Keep invalid bytes one byte wide.
+				rd.buf = append(rd.buf, 0xff)
+			} else {
+				rd.buf = utf8.AppendRune(rd.buf, r)
+			}
+		}
+		return
+	}
+	for !rd.eof && (len(rd.buf) < want || !fullTail(rd.buf)) {
+		if len(rd.buf) == cap(rd.buf) {
+			rd.buf = append(rd.buf, make([]byte, readerChunk)...)[:len(rd.buf)]
+		}
+		k, err := rd.src.Read(rd.buf[len(rd.buf):cap(rd.buf)])
+		rd.buf = rd.buf[:len(rd.buf)+k]
+		if err != nil {
+			rd.end(err)
+		}
+	}
+}
+
+// end ends the stream after err, which is kept unless it is io.EOF.
+func (rd *reader) end(err error) {
+	rd.eof = true
+	if err != io.EOF && rd.err == nil {
+		rd.err = err
+	}
+}
+
+// fullTail reports whether b does not end in the middle of a rune.
+func fullTail(b []byte) bool {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			return utf8.FullRune(b[i:])
+		}
+	}
+	return true
+}
+
+// emit writes the text up to pos that has not been written yet.
+func (rd *reader) emit(pos int) {
+	if rd.w == nil || pos <= rd.out {
+		return
+	}
+	if _, err := rd.w.Write(rd.buf[rd.out:pos]); err != nil && rd.err == nil {
+		rd.err = err
+	}
+	rd.out = pos
+}
+
+// discard drops the text before the next attempt of c but the last
+// rd.keep bytes, once enough of it has accumulated.
+func (rd *reader) discard(c *cursor) {
+	n := c.offset - rd.keep
+	if n < readerChunk || n < len(rd.buf)/2 {
+		return
+	}
+	rd.emit(c.offset)
+	rd.buf = rd.buf[:copy(rd.buf, rd.buf[n:])]
+	rd.base += n
+	rd.out -= n
+	c.offset -= n
+	c.prev -= n
+}
+
+// newReader returns a reader with the room needed by the matching of re.
+func (re *regexp) newReader(rd *reader) *reader {
+	// Text before the current attempt is only kept for lookbehind
+	// assertions, and for the rune before it that line and word
+	// assertions look at. Inline functions are given the whole text.
+	rd.keep = re.prog.behind + utf8.UTFMax
+	if len(re.funcs) > 0 {
+		rd.keep = math.MaxInt
+		for !rd.eof {
+			rd.fill(readerChunk)
+		}
+	}
+	return rd
+}
+
+// nextReader is like next for the text of a stream. The positions are
+// those in rd.buf, which are only valid until the next call.
+//
+// Each attempt runs on the text buffered so far. If it depended on where
+// the buffer ends, more text is read and the attempt is run again.
+func (re *regexp) nextReader(m *machine, rd *reader, c *cursor, mode mode) (start, end int, ok bool) {
+	longest := re.longest && mode != modeMatch
+	for rd.err == nil {
+		// An attempt needs the rune at its position, to move past it.
+		if c.offset >= len(rd.buf) && !rd.eof {
+			rd.emit(c.offset)
+			rd.fill(readerChunk)
+			continue
+		}
+		if c.offset > len(rd.buf) || re.fixed && rd.base+c.offset > 0 {
+			return 0, 0, false
+		}
+		if re.first != nil && !re.fixed {
+			if c.offset = re.first.skip(rd.buf, c.offset); c.offset == len(rd.buf) {
+				if rd.eof {
+					return 0, 0, false
+				}
+				rd.discard(c)
+				continue
+			}
+		}
+		m.b, m.partial, m.hitEnd = rd.buf, !rd.eof, false
+		end, ok := m.match(c.offset, longest, m.next())
+		if m.hitEnd {
+			// Double the text available to the attempt.
+			rd.emit(c.offset)
+			rd.fill(max(readerChunk, len(rd.buf)-c.offset))
+			continue
+		}
+		start := c.offset
+		if ok {
+			skip := start == end && start == c.prev
+			c.prev = end
+			if end > start {
+				c.offset = end
+			} else if start == len(rd.buf) {
+				c.offset++
+			} else {
+				_, size := utf8.DecodeRune(rd.buf[start:])
+				c.offset += size
+			}
+			if !skip {
+				return start, end, true
+			}
+			continue
+		}
+		if re.fixed || start == len(rd.buf) {
+			return 0, 0, false
+		}
+		_, size := utf8.DecodeRune(rd.buf[start:])
+		c.offset += size
+		rd.discard(c)
+	}
+	return 0, 0, false
+}
+
+// findReader returns the leftmost match in the text read from r, with the
+// details selected by mode.
+func (re *regexp) findReader(r io.RuneReader, mode mode) []int {
+	rd := re.newReader(&reader{r: r})
+	m := re.machine(nil, nil, mode)
+	defer re.put(m)
+	c := cursor{prev: -1}
+	start, end, ok := re.nextReader(m, rd, &c, mode)
+	if !ok {
+		return nil
+	}
+	loc := m.appendLoc(make([]int, 0, re.prog.ncap*2), start, end, mode == modeSubmatch)
+	for i, v := range loc {
+		if v >= 0 {
+			loc[i] = v + rd.base
+		}
+	}
+	return loc
+}
+
+func (re *regexp) MatchReader(r io.RuneReader) bool {
+	return re.findReader(r, modeMatch) != nil
+}
+
+func (re *regexp) FindReaderIndex(r io.RuneReader) []int {
+	return re.findReader(r, modeBounds)
+}
+
+func (re *regexp) FindReaderSubmatchIndex(r io.RuneReader) []int {
+	return re.findReader(r, modeSubmatch)
+}
+
+// replaceReader copies src to dst, replacing each match with the text
+// appended by repl. The captures of the match are in m during the call.
+func (re *regexp) replaceReader(dst io.Writer, src io.Reader, mode mode, repl func(dst []byte, m *machine, start, end int) []byte) error {
+	rd := re.newReader(&reader{src: src, w: dst})
+	m := re.machine(nil, nil, mode)
+	defer re.put(m)
+	var buf []byte
+	c := cursor{prev: -1}
+	for {
+		start, end, ok := re.nextReader(m, rd, &c, mode)
+		if !ok {
+			break
+		}
+		rd.emit(start)
+		buf = repl(buf[:0], m, start, end)
+		if _, err := dst.Write(buf); err != nil && rd.err == nil {
+			rd.err = err
+		}
+		rd.out = end
+	}
+	if rd.err == nil {
+		rd.emit(len(rd.buf))
+	}
+	if rd.err == nil && !rd.eof {
+		// The iteration can stop before the end of the text.
+		_, rd.err = io.Copy(dst, src)
+	}
+	return rd.err
+}
+
+func (re *regexp) ReplaceReader(dst io.Writer, src io.Reader, repl []byte) error {
+	var loc []int
+	return re.replaceReader(dst, src, modeSubmatch, func(dst []byte, m *machine, start, end int) []byte {
+		loc = m.appendLoc(loc[:0], start, end, true)
+		return append(dst, re.Expand(nil, repl, m.b, loc)...)
+	})
+}
+
+func (re *regexp) ReplaceReaderFunc(dst io.Writer, src io.Reader, repl func([]byte) []byte) error {
+	return re.replaceReader(dst, src, modeBounds, func(dst []byte, m *machine, start, end int) []byte {
+		return append(dst, repl(m.b[start:end])...)
+	})
+}
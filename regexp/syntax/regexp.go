@@ -2,19 +2,40 @@ package syntax
 
 import (
 	"bytes"
+	"context"
+	"iter"
 	"regexp/syntax"
-	"strconv"
-	"unicode"
+	"strings"
+	"sync"
 	"unicode/utf8"
+	"unsafe"
 )
 
 type regexp struct {
 	root        node
+	prog        *prog
+	prefilter   *prefilter
+	first       *firstSet
 	expr        string
 	subexpNames []string
 	subexpMap   map[string]int
 	longest     bool
 	funcs       []FuncMap
+
+	// calls are the functions called by the program, by their index in
+	// prog.calls, or nil for those not registered.
+	calls []func(ctx Context) interface{}
+
+	// prefix is the literal prefix of all matches, complete if it is
+	// the whole match, and fixed is set if matches can only start at
+	// the beginning of the text.
+	prefix   []byte
+	complete bool
+	fixed    bool
+
+	// machines holds idle machines, so that concurrent searches do not
+	// allocate their own.
+	machines sync.Pool
 }
 
 func (re *regexp) NumSubexp() int {
@@ -22,11 +43,12 @@ func (re *regexp) NumSubexp() int {
 }
 
 func (re *regexp) Match(b []byte) bool {
-	return len(re.Find(b)) > 0
+	loc, _ := re.find(nil, b, 0, modeMatch)
+	return loc != nil
 }
 
 func (re *regexp) MatchString(s string) bool {
-	return re.Match([]byte(s))
+	return re.Match(re.input(s))
 }
 
 func (re *regexp) Find(b []byte) []byte {
@@ -45,18 +67,37 @@ func (re *regexp) FindIndex(b []byte) []int {
 	} else if comp {
 		return []int{i, i + len(p)}
 	}
+	loc, _ := re.find(nil, b, 0, modeBounds)
+	return loc
+}
+
+func (re *regexp) FindSubmatch(b []byte) [][]byte {
 	loc := re.FindSubmatchIndex(b)
-	if len(loc) == 0 {
+	if loc == nil {
 		return nil
 	}
-	return loc[:2]
+	return submatches(b, loc)
 }
 
-func (re *regexp) FindSubmatch(b []byte) [][]byte {
-	var ret [][]byte
-	loc := re.FindSubmatchIndex(b)
-	for i := 0; i < len(loc)/2; i++ {
-		ret = append(ret, b[loc[i*2]:loc[i*2+1]])
+// submatches returns the texts of the captures at loc in b,
+// nil for the ones that did not participate in the match.
+func submatches(b []byte, loc []int) [][]byte {
+	ret := make([][]byte, len(loc)/2)
+	for i := range ret {
+		if loc[i*2] >= 0 {
+			ret[i] = b[loc[i*2]:loc[i*2+1]:loc[i*2+1]]
+		}
+	}
+	return ret
+}
+
+// substrings is like submatches for a string.
+func substrings(s string, loc []int) []string {
+	ret := make([]string, len(loc)/2)
+	for i := range ret {
+		if loc[i*2] >= 0 {
+			ret[i] = s[loc[i*2]:loc[i*2+1]]
+		}
 	}
 	return ret
 }
@@ -65,170 +106,399 @@ func (re *regexp) FindSubmatchIndex(b []byte) []int {
 	return re.findSubmatchIndex(b, 0)
 }
 
+func (re *regexp) FindSubmatchIndexContext(ctx context.Context, b []byte) ([]int, error) {
+	return re.find(&state{ctx: ctx}, b, 0, modeSubmatch)
+}
+
+func (re *regexp) MatchContext(ctx context.Context, b []byte) (bool, error) {
+	loc, err := re.find(&state{ctx: ctx}, b, 0, modeMatch)
+	return loc != nil, err
+}
+
+func (re *regexp) MatchStringContext(ctx context.Context, s string) (bool, error) {
+	return re.MatchContext(ctx, re.input(s))
+}
+
 func (re *regexp) findSubmatchIndex(b []byte, f int) []int {
-	offset := f
+	loc, _ := re.find(nil, b, f, modeSubmatch)
+	return loc
+}
+
+// mode selects the details of a match reported by find.
+type mode int
 
-	fixed := false
-	if b, _ := re.root.Hint()[hintFixedBeginning].(bool); b {
-		fixed = true
+const (
+	modeSubmatch mode = iota // the bounds of the match and of its captures
+	modeBounds               // the bounds of the match
+	modeMatch                // the bounds of any match, not necessarily the longest
+)
+
+// find returns the leftmost match in b starting at f, with the details
+// selected by mode. If st is not nil, matching stops with the context
+// error as soon as the context is done.
+func (re *regexp) find(st *state, b []byte, f int, mode mode) ([]int, error) {
+	m := re.machine(st, b, mode)
+	defer re.put(m)
+	start, end, ok := re.search(m, f, len(b), mode)
+	if !ok {
+		return nil, m.st.err
 	}
+	return m.appendLoc(make([]int, 0, re.prog.ncap*2), start, end, mode == modeSubmatch), nil
+}
+
+// machine returns an idle machine set up for searches of b reporting
+// the details selected by mode. It is given back with put.
+func (re *regexp) machine(st *state, b []byte, mode mode) *machine {
+	m, _ := re.machines.Get().(*machine)
+	if m == nil {
+		m = newMachine(re.prog)
+	}
+	m.reset(b, re.calls, st)
+	// Captures are only tracked when they are reported or referenced.
+	m.nocap = mode != modeSubmatch && !re.prog.needCaps
+	return m
+}
+
+// put returns m to the idle machines of re.
+func (re *regexp) put(m *machine) {
+	m.release()
+	re.machines.Put(m)
+}
 
+// search returns the bounds of the leftmost match starting between f
+// and last in the text of m, and leaves its captures in m. It reports
+// false if there is no such match, or if matching was abandoned in which
+// case m.st.err is set.
+func (re *regexp) search(m *machine, f, last int, mode mode) (start, end int, ok bool) {
+	b, st := m.b, m.st
+	offset := f
+
+	fixed := re.fixed
 	p, comp := re.literalPrefix()
 	i := bytes.Index(b[offset:], p)
-	if i < 0 {
-		return nil
+	if i < 0 || offset+i > last {
+		return 0, 0, false
 	} else {
 		offset += i
-		if comp && re.NumSubexp() == 0 {
-			return []int{offset, offset + len(p)}
+		if comp && (re.NumSubexp() == 0 || mode != modeSubmatch) {
+			return offset, offset + len(p), true
 		}
 	}
 
+	// next is the first occurrence of a required literal at or after offset.
+	pf := re.prefilter
+	next := -1
+
+	longest := re.longest && mode != modeMatch
+	stamp := m.next()
 	for {
-		f := re.root.Fiber(input{
-			b: b[offset:],
-			o: b, begin: offset,
-			funcs: re.funcs,
-		})
-		o, err := f.Resume()
-		if err == nil {
-			if re.longest {
-				for {
-					a, err := f.Resume()
-					if err != nil {
-						break
-					} else if a.offset > o.offset {
-						o = a
-					}
+		if st.aborted() {
+			return 0, 0, false
+		}
+		if pf != nil {
+			if next < offset {
+				if next = pf.index(b, offset); next < 0 {
+					return 0, 0, false
 				}
 			}
-			loc := make([]int, 0, re.NumSubexp()*2)
-			loc = append(loc, []int{offset, offset + o.offset}...)
-			for i := 1; i <= re.NumSubexp(); i++ {
-				if sub, ok := o.sub.i[i]; ok {
-					loc = append(loc, sub.begin, sub.begin+len(sub.b))
-				} else {
-					loc = append(loc, -1, -1)
-				}
+			// A match starting before next-dist would have to contain
+			// an occurrence before next.
+			for !fixed && pf.dist >= 0 && offset < next-pf.dist {
+				_, s := utf8.DecodeRune(b[offset:])
+				offset += s
 			}
-			return loc
 		}
-		if fixed || len(b[offset:]) == 0 {
-			break
+		if re.first != nil && !fixed {
+			if offset = re.first.skip(b, offset); offset == len(b) {
+				return 0, 0, false
+			}
+		}
+		if offset > last {
+			return 0, 0, false
+		}
+		if end, ok := m.match(offset, longest, stamp); ok {
+			return offset, end, true
+		}
+		if st.err != nil || fixed || len(b[offset:]) == 0 {
+			return 0, 0, false
 		}
 		_, s := utf8.DecodeRune(b[offset:])
 		offset += s
+		if m.noLead {
+			// The subtree every match starts with did not match, so
+			// the attempts can skip to where it does.
+			loc := re.prog.lead.FindIndex(b[offset:])
+			if loc == nil {
+				return 0, 0, false
+			}
+			offset += loc[0]
+		}
+	}
+}
+
+// cursor is the position of an iteration over successive matches.
+type cursor struct {
+	offset int // where the next search starts
+	prev   int // the end of the previous match, or -1
+}
+
+// next returns the next match of the iteration at c among the ones
+// starting at or before last, and advances c past it. An empty match
+// right after the previous match is skipped.
+func (re *regexp) next(m *machine, c *cursor, last int, mode mode) (start, end int, ok bool) {
+	b := m.b
+	for c.offset <= last {
+		start, end, ok = re.search(m, c.offset, last, mode)
+		if !ok {
+			return 0, 0, false
+		}
+		skip := start == end && start == c.prev
+		c.prev = end
+		switch {
+		case end > c.offset:
+			c.offset = end
+		case c.offset == len(b):
+			c.offset++
+		default:
+			_, s := utf8.DecodeRune(b[c.offset:])
+			c.offset += s
+		}
+		if !skip {
+			return start, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+// each calls fn with the bounds of at most n successive matches in the
+// text of m, or of all of them if n is negative. The captures of each
+// match are in m during the call.
+func (re *regexp) each(m *machine, n int, mode mode, fn func(start, end int)) error {
+	c := cursor{prev: -1}
+	for count := 0; count < n || n < 0; count++ {
+		start, end, ok := re.next(m, &c, len(m.b), mode)
+		if !ok {
+			return m.st.err
+		}
+		fn(start, end)
 	}
 	return nil
 }
 
+// appendFirst appends the location of the leftmost match in b to dst.
+func (re *regexp) appendFirst(dst []int, b []byte, mode mode) []int {
+	m := re.machine(nil, b, mode)
+	defer re.put(m)
+	if start, end, ok := re.search(m, 0, len(b), mode); ok {
+		dst = m.appendLoc(dst, start, end, mode == modeSubmatch)
+	}
+	return dst
+}
+
+// appendAll appends the locations of at most n successive matches in b
+// to dst.
+func (re *regexp) appendAll(dst []int, b []byte, n int, mode mode) []int {
+	m := re.machine(nil, b, mode)
+	defer re.put(m)
+	re.each(m, n, mode, func(start, end int) {
+		dst = m.appendLoc(dst, start, end, mode == modeSubmatch)
+	})
+	return dst
+}
+
+// all returns an iterator over the successive matches in b. The search
+// for a match only starts once the previous one has been consumed.
+func (re *regexp) all(b []byte) iter.Seq2[int, []int] {
+	return func(yield func(int, []int) bool) {
+		m := re.machine(nil, b, modeSubmatch)
+		defer re.put(m)
+		c := cursor{prev: -1}
+		for k := 0; ; k++ {
+			start, end, ok := re.next(m, &c, len(b), modeSubmatch)
+			if !ok {
+				return
+			}
+			loc := m.appendLoc(make([]int, 0, re.prog.ncap*2), start, end, true)
+			if !yield(k, loc) {
+				return
+			}
+		}
+	}
+}
+
+func (re *regexp) All(b []byte) iter.Seq[*Match] {
+	return func(yield func(*Match) bool) {
+		for k, loc := range re.all(b) {
+			m := re.newMatch(b, loc)
+			m.index = k
+			if !yield(m) {
+				return
+			}
+		}
+	}
+}
+
+func (re *regexp) AllString(s string) iter.Seq[*Match] {
+	return func(yield func(*Match) bool) {
+		for k, loc := range re.all(re.input(s)) {
+			m := re.newStringMatch(s, loc)
+			m.index = k
+			if !yield(m) {
+				return
+			}
+		}
+	}
+}
+
+func (re *regexp) AppendIndex(dst []int, b []byte) []int {
+	return re.appendFirst(dst, b, modeBounds)
+}
+
+func (re *regexp) AppendSubmatchIndex(dst []int, b []byte) []int {
+	return re.appendFirst(dst, b, modeSubmatch)
+}
+
+func (re *regexp) AppendAllIndex(dst []int, b []byte, n int) []int {
+	return re.appendAll(dst, b, n, modeBounds)
+}
+
+func (re *regexp) AppendAllSubmatchIndex(dst []int, b []byte, n int) []int {
+	return re.appendAll(dst, b, n, modeSubmatch)
+}
+
+func (re *regexp) AppendStringIndex(dst []int, s string) []int {
+	return re.AppendIndex(dst, re.input(s))
+}
+
+func (re *regexp) AppendStringSubmatchIndex(dst []int, s string) []int {
+	return re.AppendSubmatchIndex(dst, re.input(s))
+}
+
+func (re *regexp) AppendAllStringIndex(dst []int, s string, n int) []int {
+	return re.AppendAllIndex(dst, re.input(s), n)
+}
+
+func (re *regexp) AppendAllStringSubmatchIndex(dst []int, s string, n int) []int {
+	return re.AppendAllSubmatchIndex(dst, re.input(s), n)
+}
+
+func (re *regexp) CountAll(b []byte, n int) int {
+	m := re.machine(nil, b, modeBounds)
+	defer re.put(m)
+	count := 0
+	re.each(m, n, modeBounds, func(start, end int) {
+		count++
+	})
+	return count
+}
+
+func (re *regexp) CountAllString(s string, n int) int {
+	return re.CountAll(re.input(s), n)
+}
+
+// input returns the bytes of s for matching. They are shared with s
+// unless inline functions, which can modify them, are registered.
+func (re *regexp) input(s string) []byte {
+	if len(re.funcs) > 0 {
+		return []byte(s)
+	}
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
 func (re *regexp) FindAllString(s string, n int) []string {
 	var ret []string
-	for _, b := range re.FindAll([]byte(s), n) {
-		ret = append(ret, string(b))
+	for _, loc := range re.FindAllStringIndex(s, n) {
+		ret = append(ret, s[loc[0]:loc[1]])
 	}
 	return ret
 }
 
 func (re *regexp) FindAllStringIndex(s string, n int) [][]int {
-	return re.FindAllIndex([]byte(s), n)
+	return re.FindAllIndex(re.input(s), n)
 }
 
 func (re *regexp) FindAll(b []byte, n int) [][]byte {
 	var ret [][]byte
 	for _, loc := range re.FindAllIndex(b, n) {
-		ret = append(ret, b[loc[0]:loc[1]])
+		ret = append(ret, b[loc[0]:loc[1]:loc[1]])
 	}
 	return ret
 }
 
 func (re *regexp) FindAllIndex(b []byte, n int) [][]int {
-	var ret [][]int
-	for _, loc := range re.FindAllSubmatchIndex(b, n) {
-		ret = append(ret, loc[:2])
-	}
+	ret, _ := re.findAll(nil, b, n, modeBounds)
 	return ret
 }
 
 func (re *regexp) FindAllStringSubmatchIndex(s string, n int) [][]int {
-	return re.FindAllSubmatchIndex([]byte(s), n)
+	return re.FindAllSubmatchIndex(re.input(s), n)
 }
 
 func (re *regexp) FindAllStringSubmatch(s string, n int) [][]string {
 	var ret [][]string
-	for _, m := range re.FindAllSubmatch([]byte(s), n) {
-		var sub []string
-		for _, b := range m {
-			sub = append(sub, string(b))
-		}
-		ret = append(ret, sub)
+	for _, loc := range re.FindAllStringSubmatchIndex(s, n) {
+		ret = append(ret, substrings(s, loc))
 	}
 	return ret
 }
 
 func (re *regexp) FindAllSubmatch(b []byte, n int) [][][]byte {
 	var ret [][][]byte
-	for _, m := range re.FindAllSubmatchIndex(b, n) {
-		var sub [][]byte
-		for i := 0; i < len(m)/2; i++ {
-			sub = append(sub, b[m[i*2]:m[i*2+1]])
-		}
-		ret = append(ret, sub)
+	for _, loc := range re.FindAllSubmatchIndex(b, n) {
+		ret = append(ret, submatches(b, loc))
 	}
 	return ret
 }
 
 func (re *regexp) FindAllSubmatchIndex(b []byte, n int) [][]int {
+	ret, _ := re.findAll(nil, b, n, modeSubmatch)
+	return ret
+}
+
+func (re *regexp) FindAllSubmatchIndexContext(ctx context.Context, b []byte, n int) ([][]int, error) {
+	return re.findAll(&state{ctx: ctx}, b, n, modeSubmatch)
+}
+
+func (re *regexp) findAll(st *state, b []byte, n int, mode mode) ([][]int, error) {
 	var ret [][]int
-	offset := 0
-	for i := 0; i < n || n < 0; i++ {
-		m := re.findSubmatchIndex(b, offset)
-		if len(m) == 0 {
-			break
-		}
-		last := len(ret) - 1
-		if m[0] == m[1] && last >= 0 {
-			if m[0] != ret[last][1] {
-				ret = append(ret, m)
-			}
-		} else {
-			ret = append(ret, m)
-		}
-		if len(b[offset:]) == 0 {
-			break
-		}
-		if m[1] > offset {
-			offset = m[1]
-		} else {
-			_, s := utf8.DecodeRune(b[offset:])
-			offset += s
-		}
+	m := re.machine(st, b, mode)
+	defer re.put(m)
+	err := re.each(m, n, mode, func(start, end int) {
+		loc := make([]int, 0, re.prog.ncap*2)
+		ret = append(ret, m.appendLoc(loc, start, end, mode == modeSubmatch))
+	})
+	if err != nil {
+		return nil, err
 	}
-	return ret
+	return ret, nil
 }
 
 func (re *regexp) FindString(s string) string {
-	return string(re.Find([]byte(s)))
+	loc := re.FindStringIndex(s)
+	if loc == nil {
+		return ""
+	}
+	return s[loc[0]:loc[1]]
 }
 
 func (re *regexp) FindStringIndex(s string) []int {
-	return re.FindIndex([]byte(s))
+	return re.FindIndex(re.input(s))
 }
 
 func (re *regexp) FindStringSubmatch(s string) []string {
-	var ret []string
-	for _, b := range re.FindSubmatch([]byte(s)) {
-		ret = append(ret, string(b))
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil
 	}
-	return ret
+	return substrings(s, loc)
 }
 
 func (re *regexp) FindStringSubmatchIndex(s string) []int {
-	return re.FindSubmatchIndex([]byte(s))
+	return re.FindSubmatchIndex(re.input(s))
 }
 
 func (re *regexp) ReplaceAllFunc(src []byte, repl func([]byte) []byte) []byte {
-	sub, sep, _ := re.split(src)
+	sub, sep, _, _ := re.split(nil, src)
 	if len(sep) == 0 {
 		return append([]byte(nil), src...)
 	}
@@ -257,28 +527,52 @@ func (re *regexp) ReplaceAllLiteralString(src, repl string) string {
 }
 
 func (re *regexp) ReplaceAll(src, repl []byte) []byte {
-	sub, sep, match := re.split(src)
+	ret, _ := re.replaceAll(nil, src, repl)
+	return ret
+}
+
+func (re *regexp) ReplaceAllString(src, repl string) string {
+	return string(re.ReplaceAll([]byte(src), []byte(repl)))
+}
+
+func (re *regexp) ReplaceAllContext(ctx context.Context, src, repl []byte) ([]byte, error) {
+	return re.replaceAll(&state{ctx: ctx}, src, repl)
+}
+
+func (re *regexp) ReplaceAllStringContext(ctx context.Context, src, repl string) (string, error) {
+	ret, err := re.ReplaceAllContext(ctx, []byte(src), []byte(repl))
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
+}
+
+func (re *regexp) replaceAll(st *state, src, repl []byte) ([]byte, error) {
+	sub, sep, match, err := re.split(st, src)
+	if err != nil {
+		return nil, err
+	}
 	if len(sep) == 0 {
-		return append([]byte(nil), src...)
+		return append([]byte(nil), src...), nil
 	}
 	var ret []byte
 	for i, s := range sub[:len(sub)-1] {
 		ret = append(append(ret, s...), re.Expand(nil, repl, src, match[i])...)
 	}
 	ret = append(ret, sub[len(sub)-1]...)
-	return ret
-}
-
-func (re *regexp) ReplaceAllString(src, repl string) string {
-	return string(re.ReplaceAll([]byte(src), []byte(repl)))
+	return ret, nil
 }
 
-func (re *regexp) split(b []byte) ([][]byte, [][]byte, [][]int) {
+func (re *regexp) split(st *state, b []byte) ([][]byte, [][]byte, [][]int, error) {
 	var idx [][]int
 	var sep [][]byte
 	var match [][]int
+	all, err := re.findAll(st, b, -1, modeSubmatch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	before := 0
-	for _, i := range re.FindAllSubmatchIndex(b, -1) {
+	for _, i := range all {
 		idx = append(idx, []int{before, i[0]})
 		sep = append(sep, b[i[0]:i[1]])
 		match = append(match, i)
@@ -289,7 +583,7 @@ func (re *regexp) split(b []byte) ([][]byte, [][]byte, [][]int) {
 	for _, i := range idx {
 		sub = append(sub, b[i[0]:i[1]])
 	}
-	return sub, sep, match
+	return sub, sep, match, nil
 }
 
 // From http://golang.org/src/regexp/regexp.go
@@ -328,73 +622,45 @@ func (re *regexp) Split(s string, n int) []string {
 }
 
 func (re *regexp) Expand(dst []byte, template []byte, src []byte, match []int) []byte {
-	var res []byte
-	meta := false
-	runes := bytes.Runes(template)
-	for i := 0; i < len(runes); i++ {
-		switch {
-		case runes[i] == '$':
-			if meta {
-				res = append(res, '$')
-			}
-			meta = !meta
-		default:
-			if meta {
-				meta = false
-				name, l := re.parseTemplate(runes[i:])
-				if l > 0 {
-					idx, err := strconv.Atoi(name)
-					if err == nil && strconv.Itoa(idx) == name {
-						if idx < len(match)/2 {
-							res = append(res, src[match[idx*2]:match[idx*2+1]]...)
-						}
-					} else {
-						if idx, ok := re.subexpMap[name]; ok {
-							res = append(res, src[match[idx*2]:match[idx*2+1]]...)
-						}
-					}
-					i += l - 1
-					continue
-				}
-			}
-			var lit [utf8.UTFMax]byte
-			l := utf8.EncodeRune(lit[:], runes[i])
-			res = append(res, lit[:l]...)
-		}
-	}
-	copy(dst, res)
-	return res
+	return re.ExpandString(dst, unsafe.String(unsafe.SliceData(template), len(template)), unsafe.String(unsafe.SliceData(src), len(src)), match)
 }
 
+// ExpandString expands template with the syntax of the built-in engine,
+// which only has the variables of Template and $$. A '$' that does not
+// start a variable is kept as is.
 func (re *regexp) ExpandString(dst []byte, template string, src string, match []int) []byte {
-	return re.Expand(dst, []byte(template), []byte(src), match)
-}
-
-func (re *regexp) parseTemplate(exp []rune) (string, int) {
-	if len(exp) == 0 {
-		return "", 0
-	}
-	if exp[0] == '{' {
-		for i, r := range exp[1:] {
-			if r == '}' {
-				name, l := re.parseTemplate(exp[1 : i+1])
-				return name, l + 2
-			}
+	e := expander{dst: dst, src: src, names: re.subexpNames, match: match}
+	for {
+		before, after, ok := strings.Cut(template, "$")
+		if !ok {
+			break
 		}
-	} else {
-		var name string
-		for i, r := range exp {
-			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
-				var lit [utf8.UTFMax]byte
-				l := utf8.EncodeRune(lit[:], r)
-				name += string(lit[:l])
-			} else {
-				return name, i
-			}
+		e.write(before)
+		template = after
+		if strings.HasPrefix(template, "$") {
+			e.write("$")
+			template = template[1:]
+			continue
+		}
+		p := templateParser{text: template}
+		brace := strings.HasPrefix(template, "{")
+		if brace {
+			p.pos++
+		}
+		name := p.name()
+		if name == "" || brace && !strings.HasPrefix(template[p.pos:], "}") {
+			e.write("$")
+			continue
 		}
-		return name, len(exp)
+		if brace {
+			p.pos++
+		}
+		text, _ := e.group(groupItem(itemGroup, name))
+		e.write(text)
+		template = template[p.pos:]
 	}
-	return "", 0
+	e.write(template)
+	return e.dst
 }
 
 func (re *regexp) SubexpNames() []string {
@@ -407,7 +673,7 @@ func (re *regexp) LiteralPrefix() (prefix string, complete bool) {
 }
 
 func (re *regexp) literalPrefix() (prefix []byte, complete bool) {
-	return re.root.LiteralPrefix()
+	return re.prefix, re.complete
 }
 
 func (re *regexp) Longest() {
@@ -428,8 +694,19 @@ type Context struct {
 // FuncMap is the type of the map defining the mapping from names to functions.
 type FuncMap map[string]func(ctx Context) interface{}
 
+// Funcs registers the functions of funcMap for the inline function calls
+// of the expression. A name that was already registered keeps its first
+// function. A call to a name that is not registered fails to match.
 func (re *regexp) Funcs(funcMap FuncMap) {
 	re.funcs = append(re.funcs, funcMap)
+	if re.calls == nil {
+		re.calls = make([]func(ctx Context) interface{}, len(re.prog.calls))
+	}
+	for k, name := range re.prog.calls {
+		if re.calls[k] == nil {
+			re.calls[k] = funcMap[name]
+		}
+	}
 }
 
 // Compile parses a regular expression and returns, if successful,
@@ -447,10 +724,23 @@ func Compile(expr string) (re *regexp, extended bool, err error) {
 			m[n] = i
 		}
 	}
-	return &regexp{
+	if !n.IsExtended() {
+		// The built-in engine runs the pattern, so it must accept it.
+		if e := builtinError(expr); e != nil {
+			return nil, false, e
+		}
+	}
+	n = analyze(n)
+	re = &regexp{
 		root:        n,
+		prog:        compile(n, subexp, m),
+		prefilter:   newPrefilter(n),
+		first:       newFirstSet(n),
 		expr:        expr,
 		subexpNames: subexp,
 		subexpMap:   m,
-	}, n.IsExtended(), nil
+		fixed:       fixedBeginning(n),
+	}
+	re.prefix, re.complete = n.LiteralPrefix()
+	return re, n.IsExtended(), nil
 }
@@ -0,0 +1,466 @@
+package syntax
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// ErrInvalidTemplate is the code of the errors of CompileTemplate.
+const ErrInvalidTemplate syntax.ErrorCode = "invalid replacement template"
+
+// Template is a compiled replacement template. Its syntax extends the one
+// of Expand:
+//
+//	$n, ${n}        text of group n
+//	$name, ${name}  text of the group with the given name
+//	$&, \0          text of the whole match
+//	$$, \$          $
+//	${g:+yes:no}    template yes if group g participated in the match,
+//	                template no otherwise; ":no" can be omitted
+//	${g:-default}   text of group g if it participated in the match,
+//	                template default otherwise
+//	${g:~text}      template text with the case of group g, as given by
+//	                PreserveCase, or as is if g did not participate
+//	\U, \L          convert the text to upper, lower case up to \E
+//	\u, \l          convert the next rune to upper, lower case
+//	\E              end \U or \L
+//	\x              x itself, for any ASCII punctuation x
+//
+// A template is independent from the expression whose matches it expands,
+// so that names are looked up when it is expanded. A group that does not
+// exist or did not participate in the match expands to nothing.
+type Template struct {
+	text  string
+	items []templateItem
+}
+
+type itemOp int
+
+const (
+	itemText    itemOp = iota // literal text
+	itemGroup                 // text of a group
+	itemCond                  // then if a group matched, els otherwise
+	itemDefault               // text of a group, els if it did not match
+	itemCase                  // case conversion
+	itemShape                 // els with the case of a group
+)
+
+// caseMode is the case conversion of the text being expanded.
+type caseMode int
+
+const (
+	caseNone caseMode = iota
+	caseUpper
+	caseLower
+)
+
+type templateItem struct {
+	op   itemOp
+	text string // the text of itemText
+
+	// group is the index of the group, or -1 if it is referred to by name.
+	group int
+	name  string
+
+	then, els []templateItem
+
+	// mode is the conversion set by itemCase, up to \E for the whole text
+	// or for the next rune only if once is set.
+	mode caseMode
+	once bool
+}
+
+// CompileTemplate parses a replacement template. The error is a *Error
+// giving the offending part of the template.
+func CompileTemplate(template string) (*Template, error) {
+	p := templateParser{text: template}
+	items, err := p.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{text: template, items: items}, nil
+}
+
+// MustCompileTemplate is like CompileTemplate but panics if the template
+// cannot be parsed.
+func MustCompileTemplate(template string) *Template {
+	t, err := CompileTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the source text of the template.
+func (t *Template) String() string {
+	return t.text
+}
+
+// Expand appends the template to dst and returns the result, with its
+// variables replaced by the groups of the match of src at match, as
+// returned by FindSubmatchIndex, of an expression whose subexpression
+// names are names.
+func (t *Template) Expand(dst []byte, src []byte, names []string, match []int) []byte {
+	return t.ExpandString(dst, unsafe.String(unsafe.SliceData(src), len(src)), names, match)
+}
+
+// ExpandString is like Expand but the source is a string.
+func (t *Template) ExpandString(dst []byte, src string, names []string, match []int) []byte {
+	e := expander{dst: dst, src: src, names: names, match: match}
+	e.expand(t.items)
+	return e.dst
+}
+
+// templateParser parses the text of a template from pos.
+type templateParser struct {
+	text string
+	pos  int
+}
+
+func (p *templateParser) fail(start, end int) error {
+	return &Error{
+		Code:       ErrInvalidTemplate,
+		Expr:       p.text[start:end],
+		Pattern:    p.text,
+		Offset:     start,
+		RuneOffset: utf8.RuneCountInString(p.text[:start]),
+	}
+}
+
+// parse parses the items up to the end of the text, or if nested is set
+// up to the ':' or '}' that can end a part of a ${...} variable.
+func (p *templateParser) parse(nested bool) ([]templateItem, error) {
+	var items []templateItem
+	lit := func(s string) {
+		if n := len(items); n > 0 && items[n-1].op == itemText {
+			items[n-1].text += s
+		} else {
+			items = append(items, templateItem{op: itemText, text: s})
+		}
+	}
+	for p.pos < len(p.text) {
+		start := p.pos
+		switch c := p.text[p.pos]; {
+		case nested && (c == ':' || c == '}'):
+			return items, nil
+		case c == '\\':
+			if p.pos+1 == len(p.text) {
+				return nil, p.fail(start, len(p.text))
+			}
+			p.pos += 2
+			switch c := p.text[p.pos-1]; {
+			case c == '0':
+				items = append(items, templateItem{op: itemGroup})
+			case c == 'U':
+				items = append(items, templateItem{op: itemCase, mode: caseUpper})
+			case c == 'L':
+				items = append(items, templateItem{op: itemCase, mode: caseLower})
+			case c == 'E':
+				items = append(items, templateItem{op: itemCase, mode: caseNone})
+			case c == 'u':
+				items = append(items, templateItem{op: itemCase, mode: caseUpper, once: true})
+			case c == 'l':
+				items = append(items, templateItem{op: itemCase, mode: caseLower, once: true})
+			case c < utf8.RuneSelf && isASCIIPunct(rune(c)):
+				lit(string(c))
+			default:
+				_, size := utf8.DecodeRuneInString(p.text[p.pos-1:])
+				return nil, p.fail(start, p.pos-1+size)
+			}
+		case c == '$':
+			item, err := p.variable()
+			if err != nil {
+				return nil, err
+			}
+			if item.op == itemText {
+				lit(item.text)
+			} else {
+				items = append(items, item)
+			}
+		default:
+			i := strings.IndexAny(p.text[p.pos:], `\$:}`)
+			if i < 0 {
+				i = len(p.text) - p.pos
+			}
+			// ':' and '}' are only special in nested templates.
+			p.pos += max(i, 1)
+			lit(p.text[start:p.pos])
+		}
+	}
+	return items, nil
+}
+
+// variable parses the variable at pos, which starts with '$'.
+func (p *templateParser) variable() (templateItem, error) {
+	start := p.pos
+	p.pos++
+	if p.pos == len(p.text) {
+		return templateItem{}, p.fail(start, p.pos)
+	}
+	switch p.text[p.pos] {
+	case '$':
+		p.pos++
+		return templateItem{op: itemText, text: "$"}, nil
+	case '&':
+		p.pos++
+		return templateItem{op: itemGroup}, nil
+	case '{':
+	default:
+		name := p.name()
+		if name == "" {
+			return templateItem{}, p.fail(start, p.pos)
+		}
+		return groupItem(itemGroup, name), nil
+	}
+	p.pos++
+	name := p.name()
+	if name == "" || p.pos == len(p.text) {
+		return templateItem{}, p.fail(start, len(p.text))
+	}
+	item := groupItem(itemGroup, name)
+	if p.text[p.pos] == ':' && p.pos+1 < len(p.text) {
+		var err error
+		switch p.text[p.pos+1] {
+		case '+':
+			item.op = itemCond
+			p.pos += 2
+			if item.then, err = p.parse(true); err != nil {
+				return templateItem{}, err
+			}
+			if p.pos < len(p.text) && p.text[p.pos] == ':' {
+				p.pos++
+				item.els, err = p.parse(true)
+			}
+		case '-':
+			item.op = itemDefault
+			p.pos += 2
+			item.els, err = p.parse(true)
+		case '~':
+			item.op = itemShape
+			p.pos += 2
+			item.els, err = p.parse(true)
+		}
+		if err != nil {
+			return templateItem{}, err
+		}
+	}
+	if p.pos == len(p.text) || p.text[p.pos] != '}' {
+		return templateItem{}, p.fail(start, min(p.pos+1, len(p.text)))
+	}
+	p.pos++
+	return item, nil
+}
+
+// name parses the longest group name at pos.
+func (p *templateParser) name() string {
+	start := p.pos
+	for p.pos < len(p.text) {
+		r, size := utf8.DecodeRuneInString(p.text[p.pos:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		p.pos += size
+	}
+	return p.text[start:p.pos]
+}
+
+// groupItem returns the item of the given op for the group with the
+// given name, which is a number for a numbered group.
+func groupItem(op itemOp, name string) templateItem {
+	return templateItem{op: op, group: groupNumber(name), name: name}
+}
+
+// groupNumber returns the number of the group called name, or -1 if name
+// is not a number, in the same way as Expand.
+func groupNumber(name string) int {
+	num := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] < '0' || '9' < name[i] || num >= 1e8 {
+			return -1
+		}
+		num = num*10 + int(name[i]) - '0'
+	}
+	// Leading zeros are not allowed.
+	if name[0] == '0' && len(name) > 1 {
+		return -1
+	}
+	return num
+}
+
+// expander writes the expansion of a template for a match of src, which
+// starts at offset lo of the searched text.
+type expander struct {
+	dst   []byte
+	src   string
+	names []string
+	match []int
+	lo    int
+
+	mode caseMode
+	once caseMode
+}
+
+func (e *expander) expand(items []templateItem) {
+	for _, item := range items {
+		switch item.op {
+		case itemText:
+			e.write(item.text)
+		case itemGroup:
+			text, _ := e.group(item)
+			e.write(text)
+		case itemCond:
+			if _, ok := e.group(item); ok {
+				e.expand(item.then)
+			} else {
+				e.expand(item.els)
+			}
+		case itemDefault:
+			if text, ok := e.group(item); ok {
+				e.write(text)
+			} else {
+				e.expand(item.els)
+			}
+		case itemShape:
+			sub := expander{src: e.src, names: e.names, match: e.match, lo: e.lo}
+			sub.expand(item.els)
+			text := string(sub.dst)
+			if model, ok := e.group(item); ok {
+				text = PreserveCase(model, text)
+			}
+			e.write(text)
+		case itemCase:
+			if item.once {
+				e.once = item.mode
+			} else {
+				e.mode = item.mode
+			}
+		}
+	}
+}
+
+// group returns the text of the group of item, and whether it
+// participated in the match.
+func (e *expander) group(item templateItem) (string, bool) {
+	i := item.group
+	if i < 0 {
+		for k, name := range e.names {
+			if k > 0 && name == item.name {
+				i = k
+				break
+			}
+		}
+	}
+	if i < 0 || 2*i+1 >= len(e.match) || e.match[2*i] < 0 {
+		return "", false
+	}
+	return e.src[e.match[2*i]-e.lo : e.match[2*i+1]-e.lo], true
+}
+
+// write appends s with the case conversions in effect.
+func (e *expander) write(s string) {
+	if e.mode == caseNone && e.once == caseNone {
+		e.dst = append(e.dst, s...)
+		return
+	}
+	for _, r := range s {
+		mode := e.mode
+		if e.once != caseNone {
+			mode, e.once = e.once, caseNone
+		}
+		switch mode {
+		case caseUpper:
+			r = unicode.ToUpper(r)
+		case caseLower:
+			r = unicode.ToLower(r)
+		}
+		e.dst = utf8.AppendRune(e.dst, r)
+	}
+}
+
+// PreserveCase returns s with the case of model, so that a replacement
+// keeps the shape of the text it replaces:
+//
+//   - if model has no upper case letter, s is converted to lower case;
+//   - if model has several letters and no lower case one, s is converted
+//     to upper case;
+//   - otherwise the first letter of s is converted to title case if the
+//     first letter of model is upper or title case, to lower case if not,
+//     and the rest of s is kept.
+//
+// If model and s are made of the same number of words, separated by runs
+// of runes that are neither letters nor digits, each word of s gets the
+// case of the corresponding word of model instead.
+func PreserveCase(model, s string) string {
+	mw, sw := words(model), words(s)
+	if len(mw) > 1 && len(mw) == len(sw) {
+		var b strings.Builder
+		last := 0
+		for k, w := range sw {
+			b.WriteString(s[last:w[0]])
+			b.WriteString(preserveCase(model[mw[k][0]:mw[k][1]], s[w[0]:w[1]]))
+			last = w[1]
+		}
+		b.WriteString(s[last:])
+		return b.String()
+	}
+	return preserveCase(model, s)
+}
+
+// preserveCase applies the case of model to s as a single word.
+func preserveCase(model, s string) string {
+	var first rune
+	letters, upper, lower := 0, false, false
+	for _, r := range model {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if letters == 0 {
+			first = r
+		}
+		letters++
+		upper = upper || unicode.IsUpper(r) || unicode.IsTitle(r)
+		lower = lower || unicode.IsLower(r)
+	}
+	switch {
+	case letters == 0:
+		return s
+	case !upper:
+		return strings.ToLower(s)
+	case letters > 1 && !lower:
+		return strings.ToUpper(s)
+	}
+	i := strings.IndexFunc(s, unicode.IsLetter)
+	if i < 0 {
+		return s
+	}
+	r, size := utf8.DecodeRuneInString(s[i:])
+	if unicode.IsLower(first) {
+		r = unicode.ToLower(r)
+	} else {
+		r = unicode.ToTitle(r)
+	}
+	return s[:i] + string(r) + s[i+size:]
+}
+
+// words returns the bounds of the runs of letters and digits in s.
+func words(s string) [][2]int {
+	var ret [][2]int
+	start := -1
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			ret = append(ret, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ret = append(ret, [2]int{start, len(s)})
+	}
+	return ret
+}